@@ -54,7 +54,15 @@ func (a *App) Start(ctx context.Context) error {
 	defer db.CloseConnection(appDbAdapter)
 
 	// service, controllers
-	ms := services.NewMVCCService(mvccDbAdapter, appDbAdapter)
+	ms := services.NewMVCCService(mvccDbAdapter, appDbAdapter, services.LoadMVCCConfigFromEnv())
+	if err := ms.LoadSchema(ctx); err != nil {
+		return fmt.Errorf("failed to load schema: %w", err)
+	}
+	if _, err := ms.Recover(ctx); err != nil {
+		log.Error("Failed to recover transactions: %v", err)
+	}
+	ms.Start(ctx)
+
 	us := services.NewUserService(ms)
 	acs := services.NewAccountService(ms)
 	as := services.NewAuditService(ms)
@@ -62,10 +70,11 @@ func (a *App) Start(ctx context.Context) error {
 	uc := controllers.NewUserController(us)
 	acc := controllers.NewAccountController(acs)
 	ac := controllers.NewAuditController(as)
+	adc := controllers.NewAdminController(ms)
 
 	router := http.NewServeMux()
 
-	routes.RegisterRoutes(router, uc, acc, ac)
+	routes.RegisterRoutes(router, uc, acc, ac, adc)
 	routerHandler := middleware.CorsMiddleware(middleware.LoggingMiddleware(router))
 
 	appPort := fmt.Sprintf(":%s", os.Getenv("APP_PORT"))
@@ -1,7 +1,6 @@
 package controllers
 
 import (
-	"context"
 	"dt/services"
 	"dt/utils"
 	"dt/utils/log"
@@ -26,7 +25,7 @@ func (c *AccountController) ListAccounts(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	accounts, err := c.service.ListAccounts(context.Background(), userID)
+	accounts, err := c.service.ListAccounts(r.Context(), userID)
 	log.Info("Accounts: %v", accounts)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -48,7 +47,7 @@ func (c *AccountController) CreateAccount(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	account, err := c.service.CreateAccount(context.Background(), req.UserID)
+	account, err := c.service.CreateAccount(r.Context(), req.UserID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -57,6 +56,23 @@ func (c *AccountController) CreateAccount(w http.ResponseWriter, r *http.Request
 	utils.WriteJSON(w, http.StatusCreated, account)
 }
 
+func (c *AccountController) GetHistory(w http.ResponseWriter, r *http.Request) {
+	log.Info("Controller: GetHistory")
+	accountID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid account ID", http.StatusBadRequest)
+		return
+	}
+
+	history, err := c.service.History(r.Context(), accountID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, history)
+}
+
 func (c *AccountController) Deposit(w http.ResponseWriter, r *http.Request) {
 	log.Info("Controller: Deposit")
 	var req struct {
@@ -70,7 +86,7 @@ func (c *AccountController) Deposit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	account, err := c.service.Deposit(context.Background(), req.AccountID, req.Amount)
+	account, err := c.service.Deposit(r.Context(), req.AccountID, req.Amount)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -93,7 +109,7 @@ func (c *AccountController) Transfer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	account, err := c.service.Transfer(context.Background(), req.FromAccountID, req.ToAccountID, req.Amount)
+	account, err := c.service.Transfer(r.Context(), req.FromAccountID, req.ToAccountID, req.Amount)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"dt/services"
+	"dt/utils"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const defaultDeadlockLimit = 50
+
+type AdminController struct {
+	service *services.MVCCService
+}
+
+func NewAdminController(service *services.MVCCService) *AdminController {
+	return &AdminController{service: service}
+}
+
+func (c *AdminController) GetRecoveryReport(w http.ResponseWriter, r *http.Request) {
+	report := c.service.RecoveryReport()
+	if report == nil {
+		http.Error(w, "Recovery has not run", http.StatusNotFound)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, report)
+}
+
+func (c *AdminController) ListDeadlocks(w http.ResponseWriter, r *http.Request) {
+	limit := defaultDeadlockLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		l, err := strconv.Atoi(value)
+		if err != nil || l <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = l
+	}
+
+	deadlocks, err := c.service.RecentDeadlocks(r.Context(), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, deadlocks)
+}
+
+// GetGraph returns the wait-for graph and lock table as JSON, or as Graphviz
+// DOT when called with ?format=dot
+func (c *AdminController) GetGraph(w http.ResponseWriter, r *http.Request) {
+	graph, err := c.service.LockGraph(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		utils.WriteJSON(w, http.StatusOK, graph)
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(graph.DOT()))
+	default:
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+	}
+}
+
+func (c *AdminController) GetOCCStats(w http.ResponseWriter, r *http.Request) {
+	utils.WriteJSON(w, http.StatusOK, c.service.OCCStats())
+}
+
+func (c *AdminController) GetVacuumStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := c.service.VacuumStats(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, stats)
+}
+
+// Vacuum removes dead versions from the app database, then the metadata of
+// finished transactions from the mvcc database
+func (c *AdminController) Vacuum(w http.ResponseWriter, r *http.Request) {
+	count, err := c.service.VacuumContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	report, err := c.service.CollectMetadata(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "Vacuumed %d records, freed %d metadata rows (%d transactions, %d decisions, %d locks, %d paths, %d item timestamps)",
+		count, report.Total(), report.Transactions, report.Decisions, report.Locks, report.Paths, report.ItemTimestamps)
+}
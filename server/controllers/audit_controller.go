@@ -1,7 +1,6 @@
 package controllers
 
 import (
-	"context"
 	"dt/models"
 	"dt/services"
 	"dt/utils"
@@ -42,7 +41,7 @@ func (c *AuditController) CreateAudit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = c.service.CreateAudit(context.Background(), &audit)
+	err = c.service.CreateAudit(r.Context(), &audit)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -1,7 +1,6 @@
 package controllers
 
 import (
-	"context"
 	"dt/models"
 	"dt/services"
 	"dt/utils"
@@ -27,7 +26,7 @@ func (c *UserController) GetUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := c.service.GetUser(context.Background(), userID)
+	user, err := c.service.GetUser(r.Context(), userID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -45,7 +44,7 @@ func (c *UserController) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = c.service.CreateUser(context.Background(), &user)
+	err = c.service.CreateUser(r.Context(), &user)
 	if err != nil {
 		if err.Error() == "username already exists" {
 			http.Error(w, err.Error(), http.StatusConflict)
@@ -70,7 +69,7 @@ func (c *UserController) Login(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Debug("Controller: Logging in user with username: %s", credentials.Username)
 
-	user, err := c.service.GetUserByUsername(context.Background(), credentials.Username)
+	user, err := c.service.GetUserByUsername(r.Context(), credentials.Username)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
@@ -81,7 +80,7 @@ func (c *UserController) Login(w http.ResponseWriter, r *http.Request) {
 
 func (c *UserController) ListUsers(w http.ResponseWriter, r *http.Request) {
 	log.Info("Listing users")
-	users, err := c.service.ListUsers(context.Background())
+	users, err := c.service.ListUsers(r.Context())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
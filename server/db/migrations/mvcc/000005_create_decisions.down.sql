@@ -0,0 +1 @@
+DROP TABLE IF EXISTS decisions;
\ No newline at end of file
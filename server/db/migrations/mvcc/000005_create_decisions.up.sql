@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS decisions(
+    txid INT PRIMARY KEY,
+    decision TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW()
+);
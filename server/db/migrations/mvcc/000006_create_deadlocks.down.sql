@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS deadlocks_detected_idx;
+DROP TABLE IF EXISTS deadlocks;
+ALTER TABLE paths DROP COLUMN IF EXISTS record_id;
+ALTER TABLE paths DROP COLUMN IF EXISTS record_table;
@@ -0,0 +1,13 @@
+ALTER TABLE paths ADD COLUMN IF NOT EXISTS record_table TEXT;
+ALTER TABLE paths ADD COLUMN IF NOT EXISTS record_id INT;
+
+CREATE TABLE IF NOT EXISTS deadlocks(
+    id SERIAL PRIMARY KEY,
+    participants INT[] NOT NULL,
+    resources TEXT[] NOT NULL,
+    victim INT NOT NULL,
+    policy TEXT NOT NULL,
+    detected_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX deadlocks_detected_idx ON deadlocks(detected_at);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS item_timestamps;
\ No newline at end of file
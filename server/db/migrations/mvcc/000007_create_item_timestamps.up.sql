@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS item_timestamps(
+    record_table TEXT NOT NULL,
+    record_id INT NOT NULL,
+    read_ts BIGINT NOT NULL DEFAULT 0,
+    write_ts BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (record_table, record_id)
+);
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS item_timestamps_write_tx_idx;
+ALTER TABLE item_timestamps
+    DROP COLUMN IF EXISTS write_tx,
+    DROP COLUMN IF EXISTS write_committed,
+    DROP COLUMN IF EXISTS prev_write_ts,
+    DROP COLUMN IF EXISTS prev_write_tx;
\ No newline at end of file
@@ -0,0 +1,6 @@
+ALTER TABLE item_timestamps
+    ADD COLUMN IF NOT EXISTS write_tx INT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS write_committed BOOLEAN NOT NULL DEFAULT TRUE,
+    ADD COLUMN IF NOT EXISTS prev_write_ts BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS prev_write_tx INT NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS item_timestamps_write_tx_idx ON item_timestamps (write_tx) WHERE NOT write_committed;
\ No newline at end of file
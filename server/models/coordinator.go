@@ -0,0 +1,246 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"dt/utils/log"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	DecisionCommit = "commit"
+	DecisionAbort  = "abort"
+)
+
+const gidPrefix = "dt_"
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// participant is one of the databases taking part in a two-phase commit. The
+// local transaction runs on a dedicated connection so it can be prepared with
+// PREPARE TRANSACTION and finished later from any connection.
+type participant struct {
+	name     string
+	db       *sql.DB
+	conn     *sql.Conn
+	gid      string
+	prepared bool
+}
+
+// coordinator drives the two-phase commit of a transaction across the app and
+// mvcc databases. The commit decision is logged durably in the mvcc database
+// before phase two, so a crash between the phases can be resolved on restart.
+// Prepared transactions without a logged decision are presumed aborted.
+type coordinator struct {
+	txID int
+	app  *participant
+	mvcc *participant
+}
+
+func newCoordinator(txID int) *coordinator {
+	return &coordinator{
+		txID: txID,
+		app:  &participant{name: "app", db: appConn, gid: preparedGID(txID, "app")},
+		mvcc: &participant{name: "mvcc", db: mvccConn, gid: preparedGID(txID, "mvcc")},
+	}
+}
+
+func preparedGID(txID int, name string) string {
+	return fmt.Sprintf("%s%d_%s", gidPrefix, txID, name)
+}
+
+// parses the transaction id out of a global transaction identifier
+func parseGID(gid string) (int, bool) {
+	parts := strings.Split(strings.TrimPrefix(gid, gidPrefix), "_")
+	if !strings.HasPrefix(gid, gidPrefix) || len(parts) != 2 {
+		return 0, false
+	}
+	id, err := strconv.Atoi(parts[0])
+	return id, err == nil
+}
+
+func (p *participant) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return p.conn.ExecContext(ctx, query, args...)
+}
+
+func (p *participant) begin(ctx context.Context) error {
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	p.conn = conn
+
+	_, err = conn.ExecContext(ctx, "BEGIN")
+	return err
+}
+
+func (p *participant) prepare(ctx context.Context) error {
+	_, err := p.conn.ExecContext(ctx, "PREPARE TRANSACTION '"+p.gid+"'")
+	if err != nil {
+		return fmt.Errorf("failed to prepare %s participant: %v", p.name, err)
+	}
+	p.prepared = true
+	return nil
+}
+
+// finish completes the participant according to the decision. Transactions
+// that never reached the prepared state are rolled back on their connection.
+func (p *participant) finish(ctx context.Context, decision string) error {
+	if p.conn != nil {
+		if !p.prepared {
+			p.conn.ExecContext(ctx, "ROLLBACK")
+		}
+		p.conn.Close()
+		p.conn = nil
+	}
+	if !p.prepared {
+		return nil
+	}
+
+	return finishPrepared(ctx, p.db, p.gid, decision)
+}
+
+func finishPrepared(ctx context.Context, conn *sql.DB, gid string, decision string) error {
+	stmt := "ROLLBACK PREPARED '" + gid + "'"
+	if decision == DecisionCommit {
+		stmt = "COMMIT PREPARED '" + gid + "'"
+	}
+
+	_, err := conn.ExecContext(ctx, stmt)
+	return err
+}
+
+// prepare runs phase one: work is executed in a local transaction on each
+// participant and both are then prepared.
+func (c *coordinator) prepare(ctx context.Context, work func(app, mvcc execer) error) error {
+	if err := c.app.begin(ctx); err != nil {
+		return err
+	}
+	if err := c.mvcc.begin(ctx); err != nil {
+		return err
+	}
+
+	if err := work(c.app, c.mvcc); err != nil {
+		return err
+	}
+
+	if err := c.app.prepare(ctx); err != nil {
+		return err
+	}
+	return c.mvcc.prepare(ctx)
+}
+
+// decide durably logs the commit decision, which is the commit point of the
+// transaction
+func (c *coordinator) decide(ctx context.Context) error {
+	_, err := mvccConn.ExecContext(ctx, `
+        INSERT INTO decisions (txid, decision)
+        VALUES ($1, $2)`,
+		c.txID, DecisionCommit)
+	return err
+}
+
+// finish runs phase two on every participant. The app participant goes first,
+// so a snapshot never sees the transaction as finished before its versions
+// are marked committed. The decision log entry is only removed once all
+// participants are finished.
+func (c *coordinator) finish(ctx context.Context, decision string) error {
+	var errs []error
+	for _, p := range []*participant{c.app, c.mvcc} {
+		if err := p.finish(ctx, decision); err != nil {
+			errs = append(errs, fmt.Errorf("failed to finish %s participant: %v", p.name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	if decision != DecisionCommit {
+		return nil
+	}
+	_, err := mvccConn.ExecContext(ctx, "DELETE FROM decisions WHERE txid = $1", c.txID)
+	return err
+}
+
+type PreparedTx struct {
+	GID      string `json:"gid"`
+	TxID     int    `json:"txid"`
+	Database string `json:"database"`
+	Decision string `json:"decision"`
+}
+
+// ResolvePrepared finishes every prepared transaction left behind by a crash
+// between the two commit phases, using the decision log: transactions with a
+// logged commit decision are committed, all others are rolled back.
+func ResolvePrepared(ctx context.Context) ([]PreparedTx, error) {
+	resolved := make([]PreparedTx, 0)
+
+	for name, conn := range map[string]*sql.DB{"app": appConn, "mvcc": mvccConn} {
+		gids, err := listPrepared(ctx, conn)
+		if err != nil {
+			return resolved, fmt.Errorf("failed to list prepared transactions in %s: %v", name, err)
+		}
+
+		for _, gid := range gids {
+			txID, ok := parseGID(gid)
+			if !ok {
+				continue
+			}
+
+			var exists bool
+			err := mvccConn.QueryRowContext(ctx, `
+                SELECT EXISTS(SELECT 1 FROM decisions WHERE txid = $1 AND decision = $2)`,
+				txID, DecisionCommit).Scan(&exists)
+			if err != nil {
+				return resolved, err
+			}
+
+			decision := DecisionAbort
+			if exists {
+				decision = DecisionCommit
+			}
+
+			if err := finishPrepared(ctx, conn, gid, decision); err != nil {
+				return resolved, fmt.Errorf("failed to resolve %s: %v", gid, err)
+			}
+			log.Info("Resolved prepared transaction %s in %s: %s", gid, name, decision)
+
+			resolved = append(resolved, PreparedTx{GID: gid, TxID: txID, Database: name, Decision: decision})
+		}
+	}
+
+	// every prepared transaction is finished, the decisions are no longer needed
+	if _, err := mvccConn.ExecContext(ctx, "DELETE FROM decisions"); err != nil {
+		return resolved, err
+	}
+
+	return resolved, nil
+}
+
+func listPrepared(ctx context.Context, conn *sql.DB) ([]string, error) {
+	rows, err := conn.QueryContext(ctx, `
+        SELECT gid
+        FROM pg_prepared_xacts
+        WHERE database = current_database()
+        AND gid LIKE $1`,
+		gidPrefix+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	gids := make([]string, 0)
+	for rows.Next() {
+		var gid string
+		if err := rows.Scan(&gid); err != nil {
+			return nil, err
+		}
+		gids = append(gids, gid)
+	}
+	return gids, rows.Err()
+}
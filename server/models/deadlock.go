@@ -0,0 +1,399 @@
+package models
+
+import (
+	"context"
+	"dt/utils/log"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type VictimPolicy string
+
+const (
+	// abort the transaction that started last
+	VictimYoungest VictimPolicy = "youngest"
+	// abort the transaction that wrote the fewest records
+	VictimFewestRecords VictimPolicy = "fewest_records"
+	// abort the transaction with the lowest priority
+	VictimLowestPriority VictimPolicy = "lowest_priority"
+)
+
+var victimPolicy = VictimYoungest
+
+func SetVictimPolicy(policy VictimPolicy) error {
+	switch policy {
+	case VictimYoungest, VictimFewestRecords, VictimLowestPriority:
+		victimPolicy = policy
+		return nil
+	default:
+		return fmt.Errorf("unknown victim policy %q", policy)
+	}
+}
+
+// registry of the transactions opened by this process, used to inspect and
+// abort the other participants of a deadlock
+type txRegistry struct {
+	mu  sync.Mutex
+	txs map[int]*Transaction
+}
+
+var liveTxs = &txRegistry{txs: make(map[int]*Transaction)}
+
+func (r *txRegistry) add(tx *Transaction) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.txs[tx.ID] = tx
+}
+
+func (r *txRegistry) remove(txID int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.txs, txID)
+}
+
+func (r *txRegistry) get(txID int) (*Transaction, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tx, ok := r.txs[txID]
+	return tx, ok
+}
+
+// all returns the transactions running in this process
+func (r *txRegistry) all() []*Transaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	txs := make([]*Transaction, 0, len(r.txs))
+	for _, tx := range r.txs {
+		txs = append(txs, tx)
+	}
+	return txs
+}
+
+// LiveTransactions returns the read-write transactions open in this process
+func LiveTransactions() []*Transaction {
+	return liveTxs.all()
+}
+
+// abort signals the transaction to give up its current lock wait with err.
+// It reports false when the transaction is not running in this process.
+func (r *txRegistry) abort(txID int, err error) bool {
+	tx, ok := r.get(txID)
+	if !ok {
+		return false
+	}
+
+	select {
+	case tx.abortCh <- err:
+	default:
+	}
+	return true
+}
+
+// wound aborts the transaction asynchronously, see Transaction.wound. It
+// reports false when the transaction is not running in this process.
+func (r *txRegistry) wound(txID int, err error) bool {
+	tx, ok := r.get(txID)
+	if !ok {
+		return false
+	}
+
+	tx.wound(err)
+	return true
+}
+
+// txTimestamps returns the start timestamps of the given transactions
+func txTimestamps(ctx context.Context, ids []int) (map[int]int64, error) {
+	rows, err := mvccConn.QueryContext(ctx,
+		`SELECT id, timestamp FROM transactions WHERE id = ANY($1)`,
+		pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	timestamps := make(map[int]int64)
+	for rows.Next() {
+		var id int
+		var timestamp int64
+		if err := rows.Scan(&id, &timestamp); err != nil {
+			return nil, err
+		}
+		timestamps[id] = timestamp
+	}
+	return timestamps, rows.Err()
+}
+
+type waitsForEdge struct {
+	waiter   int
+	holder   int
+	resource lockKey
+}
+
+// waitsForGraph maps each waiting transaction to the transactions it waits on
+type waitsForGraph map[int][]waitsForEdge
+
+// loads the wait-for graph from the dependency paths, each edge is stored as
+// root.dependencies.tx_<waiter>.tx_<holder> with the contested resource
+func loadWaitsForGraph(ctx context.Context) (waitsForGraph, error) {
+	rows, err := mvccConn.QueryContext(ctx, `
+        SELECT ltree2text(path), COALESCE(record_table, ''), COALESCE(record_id, 0)
+        FROM paths
+        WHERE path ~ 'root.dependencies.*{2}'::lquery`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	graph := make(waitsForGraph)
+	for rows.Next() {
+		var path string
+		var resource lockKey
+		if err := rows.Scan(&path, &resource.table, &resource.id); err != nil {
+			return nil, err
+		}
+
+		labels := strings.Split(path, ".")
+		waiter, ok1 := parseTxLabel(labels[2])
+		holder, ok2 := parseTxLabel(labels[3])
+		if !ok1 || !ok2 {
+			log.Warn("Ignoring malformed dependency path %s", path)
+			continue
+		}
+		graph[waiter] = append(graph[waiter], waitsForEdge{waiter: waiter, holder: holder, resource: resource})
+	}
+	return graph, rows.Err()
+}
+
+func parseTxLabel(label string) (int, bool) {
+	id, err := strconv.Atoi(strings.TrimPrefix(label, "tx_"))
+	return id, err == nil && strings.HasPrefix(label, "tx_")
+}
+
+// cycleThrough returns the transactions of a cycle passing through start, in
+// wait order, or nil when start is not deadlocked
+func (g waitsForGraph) cycleThrough(start int) []int {
+	visited := make(map[int]bool)
+	stack := []int{start}
+
+	var visit func(node int) bool
+	visit = func(node int) bool {
+		for _, edge := range g[node] {
+			next := edge.holder
+			if next == start {
+				return true
+			}
+			if visited[next] {
+				continue
+			}
+			visited[next] = true
+			stack = append(stack, next)
+			if visit(next) {
+				return true
+			}
+			stack = stack[:len(stack)-1]
+		}
+		return false
+	}
+
+	if visit(start) {
+		return stack
+	}
+	return nil
+}
+
+// resources returns the resource contested on each edge of the cycle
+func (g waitsForGraph) resources(cycle []int) []string {
+	resources := make([]string, 0, len(cycle))
+	for i, waiter := range cycle {
+		holder := cycle[(i+1)%len(cycle)]
+		for _, edge := range g[waiter] {
+			if edge.holder == holder {
+				resources = append(resources, fmt.Sprintf("%s:%d", edge.resource.table, edge.resource.id))
+				break
+			}
+		}
+	}
+	return resources
+}
+
+// without returns a copy of the graph in which txID no longer waits or is
+// waited on
+func (g waitsForGraph) without(txID int) waitsForGraph {
+	graph := make(waitsForGraph, len(g))
+	for waiter, edges := range g {
+		if waiter == txID {
+			continue
+		}
+		for _, edge := range edges {
+			if edge.holder != txID {
+				graph[waiter] = append(graph[waiter], edge)
+			}
+		}
+	}
+	return graph
+}
+
+// selectVictim picks the transaction of the cycle to abort according to the
+// victim policy, ties go to the youngest transaction
+func selectVictim(ctx context.Context, cycle []int) (int, error) {
+	timestamps, err := txTimestamps(ctx, cycle)
+	if err != nil {
+		return 0, err
+	}
+
+	// lower scores are aborted first
+	score := func(txID int) int64 {
+		tx, ok := liveTxs.get(txID)
+		switch victimPolicy {
+		case VictimFewestRecords:
+			if ok {
+				return tx.written.Load()
+			}
+		case VictimLowestPriority:
+			if ok {
+				return int64(tx.priority)
+			}
+		}
+		return 0
+	}
+
+	victim := cycle[0]
+	for _, txID := range cycle[1:] {
+		s, vs := score(txID), score(victim)
+		if s < vs || (s == vs && timestamps[txID] > timestamps[victim]) {
+			victim = txID
+		}
+	}
+	return victim, nil
+}
+
+type Deadlock struct {
+	ID           int       `json:"id"`
+	Participants []int     `json:"participants"`
+	Resources    []string  `json:"resources"`
+	Victim       int       `json:"victim"`
+	Policy       string    `json:"policy"`
+	DetectedAt   time.Time `json:"detected_at"`
+}
+
+// recordDeadlock stores a detected deadlock in the history table
+func recordDeadlock(ctx context.Context, graph waitsForGraph, cycle []int, victim int) {
+	_, err := mvccConn.ExecContext(ctx, `
+        INSERT INTO deadlocks (participants, resources, victim, policy)
+        VALUES ($1, $2, $3, $4)`,
+		pq.Array(cycle), pq.Array(graph.resources(cycle)), victim, string(victimPolicy))
+	if err != nil {
+		log.Error("Failed to record deadlock: %v", err)
+	}
+}
+
+// checkDependencyCycle looks for a cycle in the wait-for graph passing through
+// tx. When one exists a victim is chosen: ErrDeadlockVictim is returned when
+// it is tx itself, otherwise the victim is signalled to abort its wait.
+func (tx *Transaction) checkDependencyCycle() error {
+	graph, err := loadWaitsForGraph(tx.ctx)
+	if err != nil {
+		return err
+	}
+
+	cycle := graph.cycleThrough(tx.ID)
+	if cycle == nil {
+		return nil
+	}
+
+	victim, err := selectVictim(tx.ctx, cycle)
+	if err != nil {
+		return err
+	}
+	log.Warn("Deadlock detected between transactions %v, victim is tx %d (%s)", cycle, victim, victimPolicy)
+	recordDeadlock(tx.ctx, graph, cycle, victim)
+
+	if victim != tx.ID && liveTxs.abort(victim, ErrDeadlockVictim) {
+		return nil
+	}
+	return fmt.Errorf("%w: transaction %d in cycle %v", ErrDeadlockVictim, tx.ID, cycle)
+}
+
+// DetectDeadlocks scans the whole wait-for graph, catching cycles among
+// transactions that are all already waiting. A victim is aborted for each
+// cycle until the graph is acyclic. Victims running outside this process
+// cannot be signalled and are only reported.
+func DetectDeadlocks(ctx context.Context) ([]Deadlock, error) {
+	graph, err := loadWaitsForGraph(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	waiters := make([]int, 0, len(graph))
+	for waiter := range graph {
+		waiters = append(waiters, waiter)
+	}
+	sort.Ints(waiters)
+
+	deadlocks := make([]Deadlock, 0)
+	for _, waiter := range waiters {
+		cycle := graph.cycleThrough(waiter)
+		if cycle == nil {
+			continue
+		}
+
+		victim, err := selectVictim(ctx, cycle)
+		if err != nil {
+			return deadlocks, err
+		}
+		log.Warn("Detector found deadlock between transactions %v, victim is tx %d (%s)", cycle, victim, victimPolicy)
+		recordDeadlock(ctx, graph, cycle, victim)
+
+		if !liveTxs.abort(victim, ErrDeadlockVictim) {
+			log.Warn("Deadlock victim tx %d is not running in this process", victim)
+		}
+
+		deadlocks = append(deadlocks, Deadlock{
+			Participants: cycle,
+			Resources:    graph.resources(cycle),
+			Victim:       victim,
+			Policy:       string(victimPolicy),
+			DetectedAt:   time.Now(),
+		})
+		graph = graph.without(victim)
+	}
+
+	return deadlocks, nil
+}
+
+// RecentDeadlocks returns the latest recorded deadlocks, newest first
+func RecentDeadlocks(ctx context.Context, limit int) ([]Deadlock, error) {
+	rows, err := mvccConn.QueryContext(ctx, `
+        SELECT id, participants, resources, victim, policy, detected_at
+        FROM deadlocks
+        ORDER BY detected_at DESC, id DESC
+        LIMIT $1`,
+		limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deadlocks := make([]Deadlock, 0)
+	for rows.Next() {
+		var d Deadlock
+		var participants pq.Int64Array
+		var resources pq.StringArray
+		if err := rows.Scan(&d.ID, &participants, &resources, &d.Victim, &d.Policy, &d.DetectedAt); err != nil {
+			return nil, err
+		}
+		for _, p := range participants {
+			d.Participants = append(d.Participants, int(p))
+		}
+		d.Resources = resources
+		deadlocks = append(deadlocks, d)
+	}
+	return deadlocks, rows.Err()
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTxAborted is wrapped by every error caused by the scheduler aborting a
+// transaction. Such transactions can safely be restarted.
+var ErrTxAborted = errors.New("transaction aborted")
+
+// ErrLockTimeout is returned when a lock is not granted within the
+// transaction's lock timeout
+var ErrLockTimeout = fmt.Errorf("%w: lock wait timeout", ErrTxAborted)
+
+// ErrDeadlockVictim is returned to the transaction chosen to be aborted to
+// break a deadlock
+var ErrDeadlockVictim = fmt.Errorf("%w: deadlock victim", ErrTxAborted)
+
+// ErrTimestampOrder is returned when an operation arrives too late for the
+// timestamp ordering scheduler
+var ErrTimestampOrder = fmt.Errorf("%w: timestamp ordering violation", ErrTxAborted)
+
+// ErrDied is returned to a transaction aborted by the wait-die policy
+var ErrDied = fmt.Errorf("%w: died waiting for an older transaction", ErrTxAborted)
+
+// ErrWounded is the abort reason of a transaction wounded by an older one
+// under the wound-wait policy
+var ErrWounded = fmt.Errorf("%w: wounded", ErrTxAborted)
+
+// ErrSerializationFailure is returned to a SerializableSnapshot transaction
+// whose reads and writes could not be ordered with those of concurrent
+// transactions
+var ErrSerializationFailure = fmt.Errorf("%w: serialization failure", ErrTxAborted)
+
+// ErrValidationFailed is returned when an optimistic transaction fails its
+// commit-time validation
+var ErrValidationFailed = fmt.Errorf("%w: validation failed", ErrTxAborted)
+
+// ErrReadOnlyTx is returned when a read-only transaction attempts a write
+var ErrReadOnlyTx = errors.New("transaction is read-only")
+
+// ErrTxExpired is the abort reason of a transaction rolled back because it
+// outlived its deadline. It is not retryable, a restart would likely run as
+// long.
+var ErrTxExpired = errors.New("transaction deadline exceeded")
+
+// IsRetryable reports whether err was caused by the scheduler aborting the
+// transaction rather than by the operation itself.
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrTxAborted)
+}
@@ -0,0 +1,177 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// MetadataGCReport counts the rows freed from the mvcc database
+type MetadataGCReport struct {
+	Transactions   int `json:"transactions"`
+	Decisions      int `json:"decisions"`
+	Locks          int `json:"locks"`
+	Paths          int `json:"paths"`
+	ItemTimestamps int `json:"item_timestamps"`
+}
+
+func (r *MetadataGCReport) Total() int {
+	return r.Transactions + r.Decisions + r.Locks + r.Paths + r.ItemTimestamps
+}
+
+// item timestamps younger than this are kept, covering transactions whose
+// row is not written yet
+const itemTimestampGrace = time.Minute
+
+// CollectMetadata deletes the metadata nothing refers to anymore: rows of
+// transactions that finished before the oldest snapshot and outside the
+// history retention window, their commit decisions once no participant is
+// still prepared, locks and dependency paths of finished transactions, and
+// item timestamps older than every running transaction.
+// The row with the highest ID is always kept, statement snapshots are
+// bounded by it.
+func CollectMetadata(ctx context.Context) (*MetadataGCReport, error) {
+	report := &MetadataGCReport{}
+
+	cutoff, err := oldestSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if retainFrom, err := retentionHorizon(ctx); err != nil {
+		return nil, err
+	} else if retainFrom != 0 {
+		cutoff = min(cutoff, retainFrom)
+	}
+
+	if err := collectTransactions(ctx, cutoff, report); err != nil {
+		return nil, err
+	}
+
+	prepared, err := preparedTxIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := mvccConn.ExecContext(ctx, `
+        DELETE FROM decisions
+        WHERE txid < $1 AND txid <> ALL($2)`,
+		cutoff, pq.Array(prepared))
+	if err != nil {
+		return nil, err
+	}
+	count, _ := result.RowsAffected()
+	report.Decisions = int(count)
+
+	report.Paths, err = collectPaths(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report.ItemTimestamps, err = collectItemTimestamps(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// collectTransactions deletes the locks of finished transactions, then the
+// rows of those below the cutoff. Locks reference their transaction row, so
+// both run in one transaction, in that order.
+func collectTransactions(ctx context.Context, cutoff int, report *MetadataGCReport) error {
+	t, err := mvccConn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+
+	result, err := t.ExecContext(ctx, `
+        DELETE FROM locks l
+        WHERE NOT EXISTS (
+            SELECT 1 FROM transactions t
+            WHERE t.id = l.txid AND t.status = $1)`,
+		TxActive)
+	if err != nil {
+		return err
+	}
+	locks, _ := result.RowsAffected()
+
+	result, err = t.ExecContext(ctx, `
+        DELETE FROM transactions
+        WHERE status <> $1 AND id < $2
+        AND id < (SELECT MAX(id) FROM transactions)
+        AND NOT EXISTS (SELECT 1 FROM locks WHERE txid = transactions.id)`,
+		TxActive, cutoff)
+	if err != nil {
+		return err
+	}
+	transactions, _ := result.RowsAffected()
+
+	if err := t.Commit(); err != nil {
+		return err
+	}
+	report.Locks = int(locks)
+	report.Transactions = int(transactions)
+	return nil
+}
+
+// preparedTxIDs returns the transactions with a participant still prepared
+func preparedTxIDs(ctx context.Context) ([]int64, error) {
+	var ids []int64
+	for _, conn := range []*sql.DB{appConn, mvccConn} {
+		gids, err := listPrepared(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+		for _, gid := range gids {
+			if id, ok := parseGID(gid); ok {
+				ids = append(ids, int64(id))
+			}
+		}
+	}
+	return ids, nil
+}
+
+// collectPaths deletes the dependency and lock paths naming a transaction
+// that is not active. A single statement sees every path whose transaction
+// row it sees, so the edges of a transaction opening meanwhile are kept.
+func collectPaths(ctx context.Context) (int, error) {
+	result, err := mvccConn.ExecContext(ctx, `
+        DELETE FROM paths p
+        WHERE EXISTS (
+            SELECT 1 FROM unnest(string_to_array(p.path::text, '.')) AS label
+            WHERE label ~ '^tx_[0-9]{1,18}$'
+              AND NOT EXISTS (
+                  SELECT 1 FROM transactions t
+                  WHERE t.status = $1 AND t.id = substr(label, 4)::bigint))`,
+		TxActive)
+	if err != nil {
+		return 0, err
+	}
+	count, _ := result.RowsAffected()
+	return int(count), nil
+}
+
+// collectItemTimestamps deletes the timestamps of rows last read and written
+// before the oldest running transaction started. Transactions with a later
+// timestamp pass both ordering rules against them, as against a missing row.
+// Restarted transactions take a new timestamp. Rows held by an uncommitted
+// writer are kept.
+func collectItemTimestamps(ctx context.Context) (int, error) {
+	cutoff := time.Now().Add(-itemTimestampGrace).UnixNano()
+	for _, tx := range liveTxs.all() {
+		cutoff = min(cutoff, tx.timestamp)
+	}
+
+	result, err := mvccConn.ExecContext(ctx, `
+        DELETE FROM item_timestamps
+        WHERE write_committed AND GREATEST(read_ts, write_ts) < LEAST($1,
+            (SELECT MIN(timestamp) FROM transactions WHERE status = $2))`,
+		cutoff, TxActive)
+	if err != nil {
+		return 0, err
+	}
+	count, _ := result.RowsAffected()
+	return int(count), nil
+}
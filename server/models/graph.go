@@ -0,0 +1,158 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type GraphNode struct {
+	TxID       int       `json:"txid"`
+	Status     string    `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+	AgeSeconds float64   `json:"age_seconds"`
+}
+
+type GraphEdge struct {
+	Waiter      int    `json:"waiter"`
+	Holder      int    `json:"holder"`
+	RecordTable string `json:"record_table"`
+	RecordID    int    `json:"record_id"`
+}
+
+type LockEntry struct {
+	TxID        int       `json:"txid"`
+	RecordTable string    `json:"record_table"`
+	RecordID    int       `json:"record_id"`
+	Shared      bool      `json:"shared"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// LockGraph is a snapshot of the wait-for graph and of the lock table
+type LockGraph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+	Locks []LockEntry `json:"locks"`
+}
+
+// LoadLockGraph builds the current wait-for graph from the paths table and the
+// lock table, annotating every transaction involved with its status and age
+func LoadLockGraph(ctx context.Context) (*LockGraph, error) {
+	graph := &LockGraph{
+		Nodes: make([]GraphNode, 0),
+		Edges: make([]GraphEdge, 0),
+		Locks: make([]LockEntry, 0),
+	}
+	involved := make(map[int]bool)
+
+	waitsFor, err := loadWaitsForGraph(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, edges := range waitsFor {
+		for _, edge := range edges {
+			graph.Edges = append(graph.Edges, GraphEdge{
+				Waiter:      edge.waiter,
+				Holder:      edge.holder,
+				RecordTable: edge.resource.table,
+				RecordID:    edge.resource.id,
+			})
+			involved[edge.waiter] = true
+			involved[edge.holder] = true
+		}
+	}
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		a, b := graph.Edges[i], graph.Edges[j]
+		return a.Waiter < b.Waiter || (a.Waiter == b.Waiter && a.Holder < b.Holder)
+	})
+
+	rows, err := mvccConn.QueryContext(ctx, `
+        SELECT txid, record_table, record_id, shared, created_at
+        FROM locks
+        ORDER BY record_table, record_id, txid`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var lock LockEntry
+		if err := rows.Scan(&lock.TxID, &lock.RecordTable, &lock.RecordID, &lock.Shared, &lock.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		graph.Locks = append(graph.Locks, lock)
+		involved[lock.TxID] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, 0, len(involved))
+	for id := range involved {
+		ids = append(ids, id)
+	}
+
+	rows, err = mvccConn.QueryContext(ctx, `
+        SELECT id, status, created_at, EXTRACT(EPOCH FROM NOW() - created_at)
+        FROM transactions
+        WHERE id = ANY($1)
+        ORDER BY id`,
+		pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var node GraphNode
+		if err := rows.Scan(&node.TxID, &node.Status, &node.CreatedAt, &node.AgeSeconds); err != nil {
+			return nil, err
+		}
+		graph.Nodes = append(graph.Nodes, node)
+	}
+
+	return graph, rows.Err()
+}
+
+// DOT renders the graph in Graphviz format. Transactions are ellipses and
+// waits are solid edges labelled with the contested resource; locked
+// resources are boxes linked to their holders by dotted edges labelled S for
+// shared and X for exclusive locks.
+func (g *LockGraph) DOT() string {
+	var b strings.Builder
+
+	b.WriteString("digraph waits_for {\n")
+	b.WriteString("    rankdir=LR;\n")
+
+	for _, node := range g.Nodes {
+		fmt.Fprintf(&b, "    tx_%d [shape=ellipse, label=\"tx %d\\n%s\\n%.1fs\"];\n",
+			node.TxID, node.TxID, node.Status, node.AgeSeconds)
+	}
+
+	resources := make(map[string]bool)
+	for _, lock := range g.Locks {
+		resource := fmt.Sprintf("%s:%d", lock.RecordTable, lock.RecordID)
+		if !resources[resource] {
+			resources[resource] = true
+			fmt.Fprintf(&b, "    %q [shape=box];\n", resource)
+		}
+
+		mode := "X"
+		if lock.Shared {
+			mode = "S"
+		}
+		fmt.Fprintf(&b, "    %q -> tx_%d [style=dotted, label=%q];\n", resource, lock.TxID, mode)
+	}
+
+	for _, edge := range g.Edges {
+		fmt.Fprintf(&b, "    tx_%d -> tx_%d [label=%q];\n",
+			edge.Waiter, edge.Holder, fmt.Sprintf("%s:%d", edge.RecordTable, edge.RecordID))
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
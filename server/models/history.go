@@ -0,0 +1,192 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// how long the versions ended by recent transactions are kept by vacuum,
+// zero keeps no history
+var historyRetention time.Duration
+
+// SetHistoryRetention makes vacuum keep every version ended by a transaction
+// started within the window, so time-travel reads over it stay complete
+func SetHistoryRetention(window time.Duration) error {
+	if window < 0 {
+		return fmt.Errorf("negative history retention %v", window)
+	}
+	historyRetention = window
+	return nil
+}
+
+// retentionHorizon returns the oldest transaction started within the history
+// retention window, versions it or a later transaction ended are kept. It is
+// zero when no history is retained.
+func retentionHorizon(ctx context.Context) (int, error) {
+	if historyRetention == 0 {
+		return 0, nil
+	}
+
+	var horizon int
+	err := mvccConn.QueryRowContext(ctx, `
+        SELECT COALESCE(MIN(id), 0) FROM transactions
+        WHERE created_at >= NOW() - make_interval(secs => $1)`,
+		historyRetention.Seconds()).Scan(&horizon)
+	return horizon, err
+}
+
+// Version is a committed version of a row with the transactions that created
+// and, unless it is the current version, ended it. The start times are nil
+// once the transaction rows were garbage collected by CollectMetadata.
+type Version struct {
+	CreatedBy int                    `json:"created_by"`
+	CreatedAt *time.Time             `json:"created_at"`
+	EndedBy   int                    `json:"ended_by,omitempty"`
+	EndedAt   *time.Time             `json:"ended_at,omitempty"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+// visibleAsOf reports whether the version was live once transaction asOf and
+// every transaction with a lower ID had finished. Transactions committed
+// after the snapshot are ignored so repeated reads return the same rows.
+func (tx *Transaction) visibleAsOf(row *RecordData, asOf int) bool {
+	committed := func(txID int, flag, rolledBack bool) bool {
+		return txID != 0 && txID <= asOf && flag && !rolledBack && tx.snapshot.finishedBefore(txID)
+	}
+	return committed(row.TxMin, row.TxMinCommitted, row.TxMinRolledBack) &&
+		!committed(row.TxMax, row.TxMaxCommitted, row.TxMaxRolledBack)
+}
+
+// WhereAsOf queries table like Where, but returns the rows as they were after
+// transaction asOfTxID, ordering transactions by ID. History removed by
+// vacuum cannot be read; SetHistoryRetention controls how much is kept.
+func (tx *Transaction) WhereAsOf(table string, asOfTxID int, column string, value any) ([]map[string]interface{}, error) {
+	tx.opMu.Lock()
+	defer tx.opMu.Unlock()
+
+	ts, err := LookupTable(table)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.ensureActive(); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT * FROM ` + ts.Ident() + ` WHERE `
+	var args []any
+	if column != "" {
+		col, err := ts.column(column)
+		if err != nil {
+			return nil, err
+		}
+		query += col + ` = $1 AND `
+		args = append(args, value)
+	}
+	query += `tx_min_committed AND NOT tx_min_rolled_back ORDER BY id, tx_min DESC`
+
+	if err := tx.beginStatement(); err != nil {
+		return nil, err
+	}
+
+	rows, err := appConn.QueryContext(tx.ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions, err := scanVersions(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []map[string]interface{}
+	for _, v := range versions {
+		if tx.visibleAsOf(&v.meta, asOfTxID) {
+			results = append(results, v.data)
+		}
+	}
+	return results, nil
+}
+
+// History returns the committed versions of a row visible to the snapshot,
+// oldest first
+func (tx *Transaction) History(table string, id int) ([]Version, error) {
+	tx.opMu.Lock()
+	defer tx.opMu.Unlock()
+
+	ts, err := LookupTable(table)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.ensureActive(); err != nil {
+		return nil, err
+	}
+
+	rows, err := appConn.QueryContext(tx.ctx, `
+        SELECT * FROM `+ts.Ident()+`
+        WHERE id = $1 AND tx_min_committed AND NOT tx_min_rolled_back
+        ORDER BY tx_min`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions, err := scanVersions(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]Version, 0, len(versions))
+	txIDs := make([]int64, 0, 2*len(versions))
+	for _, v := range versions {
+		if !tx.snapshot.finishedBefore(v.meta.TxMin) {
+			continue
+		}
+
+		version := Version{CreatedBy: v.meta.TxMin, Data: v.data}
+		if v.meta.TxMaxCommitted && !v.meta.TxMaxRolledBack && tx.snapshot.finishedBefore(v.meta.TxMax) {
+			version.EndedBy = v.meta.TxMax
+		}
+		history = append(history, version)
+		txIDs = append(txIDs, int64(version.CreatedBy), int64(version.EndedBy))
+	}
+
+	started, err := txStartTimes(tx.ctx, txIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range history {
+		history[i].CreatedAt = started[history[i].CreatedBy]
+		if history[i].EndedBy != 0 {
+			history[i].EndedAt = started[history[i].EndedBy]
+		}
+	}
+	return history, nil
+}
+
+// txStartTimes returns when each of the transactions whose row still exists
+// started
+func txStartTimes(ctx context.Context, txIDs []int64) (map[int]*time.Time, error) {
+	rows, err := mvccConn.QueryContext(ctx,
+		`SELECT id, created_at FROM transactions WHERE id = ANY($1)`, pq.Array(txIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	started := make(map[int]*time.Time, len(txIDs))
+	for rows.Next() {
+		var id int
+		var createdAt time.Time
+		if err := rows.Scan(&id, &createdAt); err != nil {
+			return nil, err
+		}
+		started[id] = &createdAt
+	}
+	return started, rows.Err()
+}
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+type IsolationLevel string
+
+const (
+	// ReadCommitted evaluates every statement against a fresh snapshot.
+	// Dirty reads are prevented, but a row read twice may change between
+	// the reads (non-repeatable read), a repeated query may return new rows
+	// (phantom), and two transactions may update disjoint rows after each
+	// read both (write skew).
+	ReadCommitted IsolationLevel = "read_committed"
+	// RepeatableRead evaluates every statement against the snapshot taken
+	// when the transaction opened, so repeated reads and queries return the
+	// same rows. Updating a row changed by a transaction committed after the
+	// snapshot aborts (first updater wins). Write skew is still possible.
+	// This is the default level.
+	RepeatableRead IsolationLevel = "repeatable_read"
+	// Serializable reads from the transaction snapshot and protects every
+	// read with shared table and row locks held until the end of the
+	// transaction, so writers of anything read must wait. This prevents
+	// write skew at the cost of blocking and deadlocks.
+	Serializable IsolationLevel = "serializable"
+	// SerializableSnapshot reads from the transaction snapshot without read
+	// locks and tracks what every transaction reads and writes instead.
+	// A transaction that both read something a concurrent one overwrote and
+	// wrote something a concurrent one read fails with
+	// ErrSerializationFailure, which prevents write skew without blocking
+	// readers.
+	SerializableSnapshot IsolationLevel = "serializable_snapshot"
+)
+
+func (l IsolationLevel) Validate() error {
+	switch l {
+	case ReadCommitted, RepeatableRead, Serializable, SerializableSnapshot:
+		return nil
+	default:
+		return fmt.Errorf("unknown isolation level %q", l)
+	}
+}
+
+// locking levels protect reads with shared locks held until the transaction
+// ends
+func (l IsolationLevel) locksReads() bool {
+	return l == Serializable
+}
+
+type TxOption func(*Transaction)
+
+func WithIsolation(level IsolationLevel) TxOption {
+	return func(tx *Transaction) {
+		tx.isolation = level
+	}
+}
+
+// WithLockTimeout bounds how long each lock acquisition may wait
+func WithLockTimeout(timeout time.Duration) TxOption {
+	return func(tx *Transaction) {
+		tx.lockTimeout = timeout
+	}
+}
+
+// WithDeadline bounds the lifetime of the transaction: once the deadline
+// passes its statements and lock waits fail and it is rolled back
+func WithDeadline(deadline time.Time) TxOption {
+	return func(tx *Transaction) {
+		tx.deadline = deadline
+	}
+}
+
+// WithMaxDuration sets the deadline relative to the start of the transaction
+func WithMaxDuration(d time.Duration) TxOption {
+	return func(tx *Transaction) {
+		tx.deadline = time.Now().Add(d)
+	}
+}
+
+// WithPriority sets the priority used by the lowest_priority victim policy
+func WithPriority(priority int) TxOption {
+	return func(tx *Transaction) {
+		tx.priority = priority
+	}
+}
+
+// WithTimestamp starts the transaction with the timestamp of an earlier
+// attempt, so that a restarted transaction keeps its age
+func WithTimestamp(timestamp int64) TxOption {
+	return func(tx *Transaction) {
+		tx.timestamp = timestamp
+	}
+}
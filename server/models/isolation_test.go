@@ -0,0 +1,211 @@
+package models
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+var isolationLevels = []IsolationLevel{ReadCommitted, RepeatableRead, Serializable, SerializableSnapshot}
+
+// under Serializable a conflicting operation waits for the shared or
+// exclusive locks of the other transaction; it is given this long
+const blockedTimeout = time.Second
+
+func TestDirtyRead(t *testing.T) {
+	openTestDB(t)
+
+	for _, level := range isolationLevels {
+		t.Run(string(level), func(t *testing.T) {
+			_, ids := createAccounts(t, 100)
+
+			writer := mustOpenTx(t, WithIsolation(level))
+			if err := writer.Update("accounts", ids[0], []string{"balance"}, 50); err != nil {
+				t.Fatal(err)
+			}
+
+			reader := mustOpenTx(t, WithIsolation(level), WithLockTimeout(blockedTimeout))
+			balance, err := balanceOf(reader, ids[0])
+			switch {
+			case level == Serializable && errors.Is(err, ErrLockTimeout):
+				// the read waited for the writer instead
+			case err != nil:
+				t.Fatal(err)
+			case balance != 100:
+				t.Errorf("read uncommitted balance %d, want 100", balance)
+			}
+		})
+	}
+}
+
+func TestNonRepeatableRead(t *testing.T) {
+	openTestDB(t)
+
+	for _, level := range isolationLevels {
+		t.Run(string(level), func(t *testing.T) {
+			_, ids := createAccounts(t, 100)
+
+			reader := mustOpenTx(t, WithIsolation(level))
+			first, err := balanceOf(reader, ids[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			writer := mustOpenTx(t, WithIsolation(level), WithLockTimeout(blockedTimeout))
+			err = writer.Update("accounts", ids[0], []string{"balance"}, 50)
+			if level == Serializable {
+				if !errors.Is(err, ErrLockTimeout) {
+					t.Fatalf("update of a row read under serializable returned %v, want a lock timeout", err)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := writer.Commit(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			second, err := balanceOf(reader, ids[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if level == ReadCommitted {
+				if second != 50 {
+					t.Errorf("read committed reread %d, want the committed 50", second)
+				}
+			} else if second != first {
+				t.Errorf("reread %d, first read %d", second, first)
+			}
+		})
+	}
+}
+
+func TestPhantom(t *testing.T) {
+	openTestDB(t)
+
+	for _, level := range isolationLevels {
+		t.Run(string(level), func(t *testing.T) {
+			userID, _ := createAccounts(t, 100)
+
+			reader := mustOpenTx(t, WithIsolation(level))
+			first, err := reader.Where("accounts", "user_id", userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			writer := mustOpenTx(t, WithIsolation(level), WithLockTimeout(blockedTimeout))
+			_, err = writer.Insert("accounts", []string{"user_id", "balance"}, userID, 0)
+			if level == Serializable {
+				if !errors.Is(err, ErrLockTimeout) {
+					t.Fatalf("insert into a table read under serializable returned %v, want a lock timeout", err)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := writer.Commit(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			second, err := reader.Where("accounts", "user_id", userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if level == ReadCommitted {
+				if len(second) != len(first)+1 {
+					t.Errorf("read committed requery returned %d rows, want %d", len(second), len(first)+1)
+				}
+			} else if len(second) != len(first) {
+				t.Errorf("requery returned %d rows, first query %d", len(second), len(first))
+			}
+		})
+	}
+}
+
+// TestWriteSkew runs two transactions that each check that the two accounts
+// of a user hold at least 100 together, then withdraw 100 from a different
+// one of them. Run serially, the second one would see the first withdrawal.
+func TestWriteSkew(t *testing.T) {
+	openTestDB(t)
+
+	for _, level := range isolationLevels {
+		t.Run(string(level), func(t *testing.T) {
+			_, ids := createAccounts(t, 50, 50)
+
+			txs := []*Transaction{
+				mustOpenTx(t, WithIsolation(level), WithLockTimeout(5*time.Second)),
+				mustOpenTx(t, WithIsolation(level), WithLockTimeout(5*time.Second)),
+			}
+			for _, tx := range txs {
+				var total int64
+				for _, id := range ids {
+					balance, err := balanceOf(tx, id)
+					if err != nil {
+						t.Fatal(err)
+					}
+					total += balance
+				}
+				if total < 100 {
+					t.Fatalf("total %d before any withdrawal", total)
+				}
+			}
+
+			errs := withdrawConcurrently(txs, ids)
+
+			committed := 0
+			for i, err := range errs {
+				switch {
+				case err == nil:
+					committed++
+				case !IsRetryable(err):
+					t.Errorf("transaction %d failed with %v, want a retryable abort", txs[i].ID, err)
+				}
+			}
+
+			switch level {
+			case ReadCommitted, RepeatableRead:
+				if committed != 2 {
+					t.Errorf("%d transactions committed, want the write skew of 2: %v", committed, errs)
+				}
+			default:
+				if committed != 1 {
+					t.Errorf("%d transactions committed, want 1: %v", committed, errs)
+				}
+			}
+		})
+	}
+}
+
+// withdrawConcurrently withdraws 100 from ids[i] in txs[i] and commits. The
+// first withdrawal is committed before the second one starts unless it
+// blocks, which it does under Serializable until a deadlock is resolved.
+func withdrawConcurrently(txs []*Transaction, ids []int) []error {
+	errs := make([]error, len(txs))
+	withdraw := func(i int) {
+		errs[i] = txs[i].Update("accounts", ids[i], []string{"balance"}, -50)
+		if errs[i] == nil {
+			errs[i] = txs[i].Commit()
+		}
+	}
+
+	var wg sync.WaitGroup
+	first := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		withdraw(0)
+		close(first)
+	}()
+
+	select {
+	case <-first:
+	case <-time.After(blockedTimeout):
+	}
+	withdraw(1)
+	wg.Wait()
+
+	return errs
+}
@@ -3,6 +3,8 @@ package models
 import (
 	"dt/utils/log"
 	"fmt"
+	"maps"
+	"sync"
 	"time"
 )
 
@@ -20,64 +22,392 @@ type Lock struct {
 	TxID  int
 }
 
+// DeadlockPolicy selects how the lock manager deals with deadlocks
+type DeadlockPolicy string
+
+const (
+	// waiters are checked for cycles in the wait-for graph
+	DeadlockDetection DeadlockPolicy = "detection"
+	// an older requester waits for the holder, a younger one aborts
+	WaitDie DeadlockPolicy = "wait_die"
+	// an older requester wounds (aborts) the holder, a younger one waits
+	WoundWait DeadlockPolicy = "wound_wait"
+)
+
+var deadlockPolicy = DeadlockDetection
+
+func SetDeadlockPolicy(policy DeadlockPolicy) error {
+	switch policy {
+	case DeadlockDetection, WaitDie, WoundWait:
+		deadlockPolicy = policy
+		return nil
+	default:
+		return fmt.Errorf("unknown deadlock policy %q", policy)
+	}
+}
+
+const (
+	defaultLockTimeout = 10 * time.Second
+	// safety net for locks released outside this process, e.g. by recovery
+	lockPollInterval = time.Second
+)
+
+type lockKey struct {
+	table string
+	id    int
+}
+
+type waiter struct {
+	txID     int
+	lockType LockType
+	wake     chan struct{}
+}
+
+// waitQueue keeps the transactions waiting for each resource in arrival order
+type waitQueue struct {
+	mu     sync.Mutex
+	queues map[lockKey][]*waiter
+}
+
+var lockQueue = &waitQueue{queues: make(map[lockKey][]*waiter)}
+
+func (q *waitQueue) enqueue(key lockKey, txID int, lockType LockType) *waiter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	w := &waiter{txID: txID, lockType: lockType, wake: make(chan struct{}, 1)}
+	q.queues[key] = append(q.queues[key], w)
+	return w
+}
+
+// dequeue removes w and wakes the waiters behind it
+func (q *waitQueue) dequeue(key lockKey, w *waiter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	waiters := q.queues[key]
+	for i, other := range waiters {
+		if other == w {
+			waiters = append(waiters[:i:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(q.queues, key)
+		return
+	}
+	q.queues[key] = waiters
+	q.wakeLocked(key)
+}
+
+// ahead returns the transactions queued before w with a request
+// incompatible with it. w may try to take the lock when there are none, so
+// shared requests at the head are served together and everything else one
+// at a time.
+func (q *waitQueue) ahead(key lockKey, w *waiter) []int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var blockers []int
+	for _, other := range q.queues[key] {
+		if other == w {
+			break
+		}
+		if other.txID != w.txID && !compatible(other.lockType, w.lockType) {
+			blockers = append(blockers, other.txID)
+		}
+	}
+	return blockers
+}
+
+// wake signals every waiter on the given resources to retry
+func (q *waitQueue) wake(keys ...lockKey) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, key := range keys {
+		q.wakeLocked(key)
+	}
+}
+
+func (q *waitQueue) wakeLocked(key lockKey) {
+	for _, w := range q.queues[key] {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// compatible reports whether a lock of the requested type can be granted
+// while another transaction holds a lock of the held type. Only shared locks
+// are compatible with each other.
+func compatible(held, requested LockType) bool {
+	return held == ReadLock && requested == ReadLock
+}
+
+func lockTypeOf(shared bool) LockType {
+	if shared {
+		return ReadLock
+	}
+	return WriteLock
+}
+
+// acquireLock blocks until the lock is granted. Waiters queue per resource and
+// are woken when a holder releases its locks; they are served in arrival
+// order, so a stream of readers cannot starve a writer. The wait ends with
+// ErrLockTimeout after the transaction's lock timeout, or when tx.ctx is done.
+// Optimistic, timestamp ordered and read-only transactions never lock.
 func (tx *Transaction) acquireLock(table string, id int, lockType LockType) error {
+	if tx.scheduler == OptimisticScheduler || tx.scheduler.OrdersTimestamps() || tx.readOnly {
+		return nil
+	}
+
+	key := lockKey{table: table, id: id}
+	held, owned := tx.heldLocks[key]
+	if owned && (held == WriteLock || lockType == ReadLock) {
+		return nil
+	}
+
 	// Add logging to debug
 	log.Debug("Attempting to acquire lock for table: %s, id: %d, tx: %d", table, id, tx.ID)
 
-	if id == -1 {
-		var existingLockTx int
-		err := mvccConn.QueryRowContext(tx.ctx, `
-            SELECT txid 
-            FROM locks 
-            WHERE record_table = $1 AND record_id = -1`,
-			table).Scan(&existingLockTx)
-
-		if err == nil {
-			log.Debug("Table lock exists, adding dependency from tx %d to tx %d", tx.ID, existingLockTx)
-			if err := tx.addDependency(existingLockTx); err != nil {
-				return err
+	w := lockQueue.enqueue(key, tx.ID, lockType)
+	defer lockQueue.dequeue(key, w)
+
+	timeout := time.NewTimer(tx.lockTimeout)
+	defer timeout.Stop()
+	poll := time.NewTicker(lockPollInterval)
+	defer poll.Stop()
+
+	waitingOn := make(map[int]bool)
+	defer func() {
+		if len(waitingOn) == 0 {
+			return
+		}
+		if err := tx.removeDependencies(); err != nil {
+			log.Error("Failed to remove dependencies of tx %d: %v", tx.ID, err)
+		}
+	}()
+
+	for {
+		// upgrades skip the queue, the waiters ahead may be waiting on tx
+		blockers := lockQueue.ahead(key, w)
+		if owned || len(blockers) == 0 {
+			holders, err := tx.tryLock(table, id, lockType)
+			if err != nil {
+				return fmt.Errorf("failed to acquire lock: %v", err)
+			}
+			if len(holders) == 0 {
+				tx.heldLocks[key] = lockType
+				tx.grants = append(tx.grants, lockGrant{key: key, upgrade: owned})
+				// a pending abort is stale once the wait is over
+				select {
+				case <-tx.abortCh:
+				default:
+				}
+				return nil
 			}
-			time.Sleep(operationDelay)
-			return tx.acquireLock(table, id, lockType)
+			blockers = holders
 		}
 
-		// Create new table lock
-		log.Debug("Creating new table lock for tx %d", tx.ID)
-		_, err = mvccConn.ExecContext(tx.ctx, `
-            INSERT INTO locks (record_table, record_id, txid, shared)
-            VALUES ($1, -1, $2, $3)`,
-			table, tx.ID, lockType == ReadLock)
+		if err := tx.preventDeadlock(blockers); err != nil {
+			return err
+		}
+		// conflicting holders, or incompatible waiters queued ahead
+		if err := tx.waitFor(blockers, key, waitingOn); err != nil {
+			return err
+		}
+
+		select {
+		case <-w.wake:
+		case <-poll.C:
+		case <-timeout.C:
+			return fmt.Errorf("%w: waited %v for %s_%d", ErrLockTimeout, tx.lockTimeout, table, id)
+		case err := <-tx.abortCh:
+			return err
+		case <-tx.ctx.Done():
+			return tx.ctxErr()
+		}
+	}
+}
+
+// waitFor records the wait-for edges from tx to the transactions blocking
+// it. The edges are replaced when the blockers change, so the graph never
+// holds an edge to a transaction tx no longer waits for.
+func (tx *Transaction) waitFor(blockers []int, key lockKey, waitingOn map[int]bool) error {
+	current := make(map[int]bool, len(blockers))
+	for _, blocker := range blockers {
+		current[blocker] = true
+	}
+	if maps.Equal(current, waitingOn) {
+		return nil
+	}
+
+	if len(waitingOn) > 0 {
+		if err := tx.removeDependencies(); err != nil {
+			return err
+		}
+		clear(waitingOn)
+	}
+	for blocker := range current {
+		waitingOn[blocker] = true
+		log.Debug("Lock wait, adding dependency from tx %d to tx %d", tx.ID, blocker)
+		if err := tx.addDependency(blocker, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// preventDeadlock applies the wait-die or wound-wait policy before tx waits
+// for the holders, comparing start timestamps: under wait-die tx aborts when
+// it is younger than a holder, under wound-wait it wounds every younger
+// holder. Either way a transaction only ever waits for older (or only for
+// younger) ones, so no cycle can form.
+func (tx *Transaction) preventDeadlock(holders []int) error {
+	if deadlockPolicy == DeadlockDetection {
+		return nil
+	}
+
+	timestamps, err := txTimestamps(tx.ctx, holders)
+	if err != nil {
 		return err
 	}
 
-	// First check if lock exists
-	var existingLock Lock
-	err := mvccConn.QueryRowContext(tx.ctx, `
-        SELECT record_table, record_id, txid 
-        FROM locks 
+	for _, holder := range holders {
+		older := tx.timestamp < timestamps[holder] ||
+			(tx.timestamp == timestamps[holder] && tx.ID < holder)
+
+		switch {
+		case deadlockPolicy == WaitDie && !older:
+			return fmt.Errorf("%w: tx %d is younger than holder tx %d", ErrDied, tx.ID, holder)
+		case deadlockPolicy == WoundWait && older:
+			reason := fmt.Errorf("%w by tx %d", ErrWounded, tx.ID)
+			if !liveTxs.wound(holder, reason) {
+				log.Warn("Cannot wound tx %d, it is not running in this process", holder)
+			}
+		}
+	}
+	return nil
+}
+
+// tryLock grants the lock when it is compatible with the locks held by every
+// other transaction, otherwise it returns the conflicting holders. A shared
+// lock already held by tx is upgraded when tx is its sole holder.
+func (tx *Transaction) tryLock(table string, id int, lockType LockType) ([]int, error) {
+	t, err := mvccConn.BeginTx(tx.ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Rollback()
+
+	// serialize concurrent acquisitions of the same resource
+	_, err = t.ExecContext(tx.ctx, `SELECT pg_advisory_xact_lock(hashtext($1 || '_' || $2::text))`, table, id)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := t.QueryContext(tx.ctx, `
+        SELECT txid, shared
+        FROM locks
         WHERE record_table = $1 AND record_id = $2`,
-		table, id).Scan(&existingLock.Table, &existingLock.ID, &existingLock.TxID)
+		table, id)
+	if err != nil {
+		return nil, err
+	}
 
-	if err == nil {
-		// Lock exists - add dependency and wait
-		log.Debug("Lock exists, adding dependency from tx %d to tx %d", tx.ID, existingLock.TxID)
-		if err := tx.addDependency(existingLock.TxID); err != nil {
-			return err
+	holders := make([]int, 0)
+	owned, ownedType := false, ReadLock
+	for rows.Next() {
+		var lock Lock
+		var shared bool
+		if err := rows.Scan(&lock.TxID, &shared); err != nil {
+			rows.Close()
+			return nil, err
 		}
-		time.Sleep(operationDelay) // Use the configured delay
-		return tx.acquireLock(table, id, lockType)
+		lock.Type = lockTypeOf(shared)
+
+		if lock.TxID == tx.ID {
+			owned = true
+			if lock.Type == WriteLock {
+				ownedType = WriteLock
+			}
+			continue
+		}
+		if !compatible(lock.Type, lockType) {
+			holders = append(holders, lock.TxID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	// Create new lock
-	log.Debug("Creating new lock for tx %d", tx.ID)
-	_, err = mvccConn.ExecContext(tx.ctx, `
-        INSERT INTO locks (record_table, record_id, txid, shared)
-        VALUES ($1, $2, $3, $4)`,
-		table, id, tx.ID, lockType == ReadLock)
+	if len(holders) > 0 {
+		return holders, nil
+	}
 
+	switch {
+	case owned && (ownedType == WriteLock || lockType == ReadLock):
+		// already held in a mode at least as strong as requested
+		return nil, nil
+	case owned:
+		log.Debug("Upgrading lock on %s_%d to exclusive for tx %d", table, id, tx.ID)
+		_, err = t.ExecContext(tx.ctx, `
+            UPDATE locks SET shared = FALSE
+            WHERE record_table = $1 AND record_id = $2 AND txid = $3`,
+			table, id, tx.ID)
+	default:
+		log.Debug("Creating new lock for tx %d", tx.ID)
+		_, err = t.ExecContext(tx.ctx, `
+            INSERT INTO locks (record_table, record_id, txid, shared)
+            VALUES ($1, $2, $3, $4)`,
+			table, id, tx.ID, lockType == ReadLock)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to acquire lock: %v", err)
+		return nil, err
 	}
 
+	return nil, t.Commit()
+}
+
+// timestamp ordering schedulers order reads without locks
+func (tx *Transaction) locksReads() bool {
+	return !tx.readOnly && tx.scheduler == LockingScheduler && tx.isolation.locksReads()
+}
+
+// lockTableForRead takes the shared table lock protecting a read under a
+// locking isolation level. Every writer holds the table lock exclusively, so
+// this also prevents phantoms.
+func (tx *Transaction) lockTableForRead(table string) error {
+	if !tx.locksReads() {
+		return nil
+	}
+
+	if err := tx.acquireLock(table, -1, ReadLock); err != nil {
+		tx.rollback()
+		return fmt.Errorf("failed to acquire table lock: %w", err)
+	}
+	return nil
+}
+
+// lockRowsForRead takes a shared lock on each row returned by a read under a
+// locking isolation level
+func (tx *Transaction) lockRowsForRead(table string, results []map[string]interface{}) error {
+	if !tx.locksReads() {
+		return nil
+	}
+
+	for _, result := range results {
+		id, ok := result["id"].(int64)
+		if !ok {
+			continue
+		}
+		if err := tx.acquireLock(table, int(id), ReadLock); err != nil {
+			tx.rollback()
+			return fmt.Errorf("failed to acquire record lock: %w", err)
+		}
+	}
 	return nil
 }
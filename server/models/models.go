@@ -20,6 +20,9 @@ const (
 	OpInsert = "insert"
 	OpUpdate = "update"
 	OpDelete = "delete"
+	// in-place update of a version created by the same transaction, only
+	// recorded while a savepoint exists so that it can be undone
+	OpOverwrite = "overwrite"
 )
 
 type Models struct {
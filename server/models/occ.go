@@ -0,0 +1,190 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// occTx is the read and write set of a transaction running under the
+// optimistic scheduler
+type occTx struct {
+	startSeq   uint64
+	reads      map[lockKey]bool
+	predicates []predicate
+	writes     map[lockKey]map[string]string
+	// validated and not yet committed or aborted
+	committing bool
+}
+
+// occCommit is the write set of a committed optimistic transaction
+type occCommit struct {
+	seq    uint64
+	txID   int
+	writes map[lockKey]map[string]string
+}
+
+// occValidator performs backward validation: a committing transaction is
+// checked against every optimistic transaction that committed after it
+// started, and fails if one of them wrote something it read or wrote.
+// Transactions that passed validation but whose commit is still in flight
+// are validated against as if they had committed, so mu is only held while
+// validating and not across the two-phase commit.
+type occValidator struct {
+	mu        sync.Mutex
+	seq       uint64
+	active    map[int]*occTx
+	committed []occCommit
+
+	validations atomic.Int64
+	failures    atomic.Int64
+}
+
+var occ = &occValidator{active: make(map[int]*occTx)}
+
+// OCCStats counts the commit-time validations of optimistic transactions
+type OCCStats struct {
+	Validations int64 `json:"validations"`
+	Failures    int64 `json:"failures"`
+	Active      int   `json:"active"`
+}
+
+func OCCMetrics() OCCStats {
+	occ.mu.Lock()
+	active := len(occ.active)
+	occ.mu.Unlock()
+
+	return OCCStats{
+		Validations: occ.validations.Load(),
+		Failures:    occ.failures.Load(),
+		Active:      active,
+	}
+}
+
+// register must run before the transaction takes its snapshot, so every
+// commit numbered up to startSeq is visible to it
+func (v *occValidator) register(txID int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.active[txID] = &occTx{
+		startSeq: v.seq,
+		reads:    make(map[lockKey]bool),
+		writes:   make(map[lockKey]map[string]string),
+	}
+}
+
+func (v *occValidator) read(txID int, pred predicate, ids []int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	t, ok := v.active[txID]
+	if !ok {
+		return
+	}
+	t.predicates = append(t.predicates, pred)
+	for _, id := range ids {
+		t.reads[lockKey{table: pred.table, id: id}] = true
+	}
+}
+
+func (v *occValidator) write(txID int, key lockKey, values map[string]string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if t, ok := v.active[txID]; ok {
+		recordWrite(t.writes, key, values)
+	}
+}
+
+// beginCommit validates the transaction against the transactions that
+// committed since it started and those still committing. On success the
+// transaction is marked committing until endCommit.
+func (v *occValidator) beginCommit(txID int) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	t, ok := v.active[txID]
+	if !ok {
+		return nil
+	}
+
+	v.validations.Add(1)
+	for _, c := range v.committed {
+		if c.seq <= t.startSeq {
+			continue
+		}
+		if key, ok := t.conflicts(c.writes); ok {
+			v.failures.Add(1)
+			return fmt.Errorf("%w: tx %d read or wrote %s_%d, written by tx %d since it started",
+				ErrValidationFailed, txID, key.table, key.id, c.txID)
+		}
+	}
+	for id, other := range v.active {
+		if !other.committing {
+			continue
+		}
+		if key, ok := t.conflicts(other.writes); ok {
+			v.failures.Add(1)
+			return fmt.Errorf("%w: tx %d read or wrote %s_%d, written by committing tx %d",
+				ErrValidationFailed, txID, key.table, key.id, id)
+		}
+	}
+
+	t.committing = true
+	return nil
+}
+
+// conflicts reports a key of writes the transaction read, wrote or matched
+// with one of its predicates
+func (t *occTx) conflicts(writes map[lockKey]map[string]string) (lockKey, bool) {
+	for key, values := range writes {
+		if t.reads[key] || t.writes[key] != nil {
+			return key, true
+		}
+		for _, pred := range t.predicates {
+			if pred.matches(key.table, values) {
+				return key, true
+			}
+		}
+	}
+	return lockKey{}, false
+}
+
+// endCommit publishes the write set of a committed transaction. It does
+// nothing for transactions that did not pass beginCommit.
+func (v *occValidator) endCommit(txID int, committed bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	t, ok := v.active[txID]
+	if !ok || !t.committing {
+		return
+	}
+	t.committing = false
+
+	if committed && len(t.writes) > 0 {
+		v.seq++
+		v.committed = append(v.committed, occCommit{seq: v.seq, txID: txID, writes: t.writes})
+	}
+}
+
+// finish forgets the transaction and every committed write set that no
+// running transaction has to be validated against anymore
+func (v *occValidator) finish(txID int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	delete(v.active, txID)
+
+	oldest := v.seq
+	for _, t := range v.active {
+		oldest = min(oldest, t.startSeq)
+	}
+
+	i := 0
+	for i < len(v.committed) && v.committed[i].seq <= oldest {
+		i++
+	}
+	v.committed = v.committed[i:]
+}
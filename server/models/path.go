@@ -40,24 +40,34 @@ func NewLockPath(txID int, table string, recordID int) *Path {
 }
 
 // Add to transaction.go
-func (tx *Transaction) addDependency(targetTxID int) error {
+// addDependency records that tx waits for targetTxID to release the lock on
+// the contested resource
+func (tx *Transaction) addDependency(targetTxID int, resource lockKey) error {
 	path := NewDependencyPath(tx.ID, targetTxID)
 
 	_, err := mvccConn.ExecContext(tx.ctx, `
-        INSERT INTO paths (path, type, name, dependency_type)
-        VALUES (text2ltree($1), $2, $3, $4)`,
-		path.Path, path.Type, path.Name, DependencyTarget)
+        INSERT INTO paths (path, type, name, dependency_type, record_table, record_id)
+        VALUES (text2ltree($1), $2, $3, $4, $5, $6)`,
+		path.Path, path.Type, path.Name, DependencyTarget, resource.table, resource.id)
 
 	if err != nil {
 		return fmt.Errorf("failed to add dependency: %v", err)
 	}
 
-	// Check for cycles after adding dependency
-	if err := tx.checkDependencyCycle(); err != nil {
-		// Remove the dependency if cycle is detected
-		tx.cleanupDependencies()
-		return err
+	// Prevention policies never let a cycle form
+	if deadlockPolicy != DeadlockDetection {
+		return nil
 	}
 
-	return nil
+	// Check for cycles after adding dependency
+	return tx.checkDependencyCycle()
+}
+
+// removeDependencies drops the wait-for edges of tx once its wait ends
+func (tx *Transaction) removeDependencies() error {
+	_, err := mvccConn.ExecContext(tx.ctx, `
+        DELETE FROM paths
+        WHERE path ~ ('root.dependencies.tx_' || $1::text || '.*{1}')::lquery`,
+		tx.ID)
+	return err
 }
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// snapshotRegistry holds the snapshots of open read-only transactions. They
+// have no row in the transactions table, so vacuum asks here which versions
+// they may still read.
+type snapshotRegistry struct {
+	mu        sync.Mutex
+	snapshots map[*Transaction]*Snapshot
+}
+
+var readOnlySnapshots = &snapshotRegistry{snapshots: make(map[*Transaction]*Snapshot)}
+
+func (r *snapshotRegistry) set(tx *Transaction, snapshot *Snapshot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.snapshots[tx] = snapshot
+}
+
+func (r *snapshotRegistry) remove(tx *Transaction) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.snapshots, tx)
+}
+
+// oldest returns the lowest XMin of the open read-only snapshots, or 0 when
+// there are none
+func (r *snapshotRegistry) oldest() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	oldest := 0
+	for _, s := range r.snapshots {
+		if oldest == 0 || s.XMin < oldest {
+			oldest = s.XMin
+		}
+	}
+	return oldest
+}
+
+// OpenReadOnlyTx opens a transaction that only reads from a snapshot. It has
+// no transaction row and no ID, takes no locks, is not seen by the
+// schedulers and refuses writes; committing it only closes the snapshot.
+// Only the ReadCommitted and RepeatableRead levels apply.
+func OpenReadOnlyTx(ctx context.Context, opts ...TxOption) (*Transaction, error) {
+	tx := &Transaction{
+		TransactionData: TransactionData{Status: TxActive},
+		records:         make([]Record, 0),
+		isolation:       RepeatableRead,
+		scheduler:       LockingScheduler,
+		heldLocks:       make(map[lockKey]LockType),
+		abortCh:         make(chan error, 1),
+		readOnly:        true,
+	}
+	for _, opt := range opts {
+		opt(tx)
+	}
+	if tx.isolation != ReadCommitted && tx.isolation != RepeatableRead {
+		return nil, fmt.Errorf("read-only transactions do not support isolation level %q", tx.isolation)
+	}
+
+	snapshot, err := takeSnapshot(ctx, 0, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take snapshot: %v", err)
+	}
+	tx.setSnapshot(snapshot)
+
+	tx.watch(ctx)
+
+	return tx, nil
+}
+
+// ensureWritable rejects writes of read-only and finished transactions
+func (tx *Transaction) ensureWritable() error {
+	if err := tx.ensureActive(); err != nil {
+		return err
+	}
+	if tx.readOnly {
+		return ErrReadOnlyTx
+	}
+	return nil
+}
+
+// finishReadOnly ends a read-only transaction with the given status
+func (tx *Transaction) finishReadOnly(status string) {
+	if tx.Status != TxActive {
+		return
+	}
+	tx.Status = status
+	readOnlySnapshots.remove(tx)
+	tx.stopWatch()
+	tx.cancel()
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"context"
+	"dt/utils/log"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// abandon rolls back a transaction whose context ended while it was still
+// open, because the caller went away or its deadline passed
+func (tx *Transaction) abandon() {
+	if errors.Is(tx.ctx.Err(), context.DeadlineExceeded) {
+		tx.setAbort(fmt.Errorf("%w: deadline %v", ErrTxExpired, tx.deadline.Format(time.RFC3339Nano)))
+	}
+	if err := tx.Rollback(); err != nil {
+		log.Error("Failed to roll back abandoned transaction %d: %v", tx.ID, err)
+	}
+}
+
+// ReapExpired rolls back transactions that outlived their deadline. Live
+// transactions are wounded, active transaction rows older than maxAge that
+// no transaction in this process owns are orphans and are recovered like
+// after a crash, releasing their locks and dependency paths.
+//
+// Ownership is only known for the transactions of this process: the
+// transactions table records no owner, so when several processes share the
+// mvcc database an old transaction of another live process is taken for an
+// orphan and rolled back under it. maxAge must then exceed the longest
+// transaction any process runs, or the reaper must run in a single process.
+func ReapExpired(ctx context.Context, maxAge time.Duration) (int, error) {
+	now := time.Now()
+	reaped := 0
+
+	for _, tx := range liveTxs.all() {
+		if tx.deadline.IsZero() || now.Before(tx.deadline) {
+			continue
+		}
+		tx.wound(fmt.Errorf("%w: deadline %v", ErrTxExpired, tx.deadline.Format(time.RFC3339Nano)))
+		reaped++
+	}
+
+	rows, err := mvccConn.QueryContext(ctx, `
+        SELECT id FROM transactions
+        WHERE status = $1 AND created_at < NOW() - make_interval(secs => $2)`,
+		TxActive, maxAge.Seconds())
+	if err != nil {
+		return reaped, err
+	}
+	var orphans []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return reaped, err
+		}
+		if _, ok := liveTxs.get(id); !ok {
+			orphans = append(orphans, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return reaped, err
+	}
+
+	report := &RecoveryReport{}
+	for _, id := range orphans {
+		recovered, err := recoverTx(ctx, id, report)
+		if err != nil {
+			return reaped, fmt.Errorf("failed to reap transaction %d: %w", id, err)
+		}
+		if recovered {
+			reaped++
+		}
+	}
+	return reaped, nil
+}
@@ -4,7 +4,10 @@ type Record struct {
 	Table     string
 	ID        int
 	Operation string
-	LockID    int
+	// tx_min of the version ended by an OpUpdate or OpDelete
+	EndedTxMin int
+	// column values before an OpOverwrite
+	Previous map[string]any
 }
 
 type RecordData struct {
@@ -0,0 +1,166 @@
+package models
+
+import (
+	"context"
+	"dt/utils/log"
+	"fmt"
+	"time"
+)
+
+type RecoveryReport struct {
+	StartedAt          time.Time    `json:"started_at"`
+	Duration           string       `json:"duration"`
+	Prepared           []PreparedTx `json:"prepared"`
+	RolledBack         []int        `json:"rolled_back"`
+	VersionsRolledBack int          `json:"versions_rolled_back"`
+	LocksReleased      int          `json:"locks_released"`
+	PathsRemoved       int          `json:"paths_removed"`
+}
+
+// Recover cleans up after a crash. Interrupted two-phase commits are resolved
+// first, so that transactions whose commit was decided are not rolled back.
+// Every transaction still active afterwards is an orphan: its versions are
+// rolled back in every versioned table and its locks and paths are removed.
+// It must run before any new transaction is opened.
+func Recover(ctx context.Context) (*RecoveryReport, error) {
+	report := &RecoveryReport{
+		StartedAt:  time.Now(),
+		RolledBack: make([]int, 0),
+	}
+	defer func() {
+		report.Duration = time.Since(report.StartedAt).String()
+	}()
+
+	prepared, err := ResolvePrepared(ctx)
+	report.Prepared = prepared
+	if err != nil {
+		return report, err
+	}
+
+	rows, err := mvccConn.QueryContext(ctx, `SELECT id FROM transactions WHERE status = $1`, TxActive)
+	if err != nil {
+		return report, err
+	}
+
+	orphans := make([]int, 0)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return report, err
+		}
+		orphans = append(orphans, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	for _, txID := range orphans {
+		recovered, err := recoverTx(ctx, txID, report)
+		if err != nil {
+			return report, fmt.Errorf("failed to recover transaction %d: %v", txID, err)
+		}
+		if recovered {
+			report.RolledBack = append(report.RolledBack, txID)
+		}
+	}
+
+	log.Info("Recovery finished: %d prepared resolved, %d transactions rolled back, %d versions, %d locks, %d paths",
+		len(report.Prepared), len(report.RolledBack), report.VersionsRolledBack, report.LocksReleased, report.PathsRemoved)
+
+	return report, nil
+}
+
+// rolls back an orphaned transaction without its in-memory records, by
+// scanning the versioned tables for the versions it wrote. The transaction
+// row is claimed first and stays locked until the cleanup is done, so a
+// transaction finished or recovered concurrently is skipped; it reports
+// whether txID was rolled back.
+func recoverTx(ctx context.Context, txID int, report *RecoveryReport) (bool, error) {
+	mt, err := mvccConn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := mt.ExecContext(ctx, `UPDATE transactions SET status = $1 WHERE id = $2 AND status = $3`,
+		TxRolledBack, txID, TxActive)
+	if err != nil {
+		mt.Rollback()
+		return false, err
+	}
+	if claimed, _ := result.RowsAffected(); claimed == 0 {
+		mt.Rollback()
+		log.Info("Transaction %d is no longer active, skipping its recovery", txID)
+		return false, nil
+	}
+
+	t, err := appConn.BeginTx(ctx, nil)
+	if err != nil {
+		mt.Rollback()
+		return false, err
+	}
+
+	versions := 0
+	for _, table := range VersionedTables() {
+		result, err := t.ExecContext(ctx, `UPDATE `+quoteIdent(table)+`
+            SET tx_min_rolled_back = TRUE
+            WHERE tx_min = $1 AND NOT tx_min_committed AND NOT tx_min_rolled_back`, txID)
+		if err != nil {
+			t.Rollback()
+			mt.Rollback()
+			return false, err
+		}
+		count, _ := result.RowsAffected()
+		versions += int(count)
+
+		result, err = t.ExecContext(ctx, `UPDATE `+quoteIdent(table)+`
+            SET tx_max = 0, tx_max_committed = FALSE, tx_max_rolled_back = TRUE
+            WHERE tx_max = $1 AND NOT tx_max_committed`, txID)
+		if err != nil {
+			t.Rollback()
+			mt.Rollback()
+			return false, err
+		}
+		count, _ = result.RowsAffected()
+		versions += int(count)
+	}
+
+	if err := t.Commit(); err != nil {
+		mt.Rollback()
+		return false, err
+	}
+
+	result, err = mt.ExecContext(ctx, "DELETE FROM locks WHERE txid = $1", txID)
+	if err != nil {
+		mt.Rollback()
+		return false, err
+	}
+	locks, _ := result.RowsAffected()
+
+	result, err = mt.ExecContext(ctx, `
+        DELETE FROM paths
+        WHERE path ~ ('root.*.tx_' || $1::text || '.*')::lquery`,
+		txID)
+	if err != nil {
+		mt.Rollback()
+		return false, err
+	}
+	paths, _ := result.RowsAffected()
+
+	if err := restoreWriteTimestamps(ctx, mt, txID); err != nil {
+		mt.Rollback()
+		return false, err
+	}
+
+	if err := mt.Commit(); err != nil {
+		return false, err
+	}
+
+	report.VersionsRolledBack += versions
+	report.LocksReleased += int(locks)
+	report.PathsRemoved += int(paths)
+	log.Info("Recovered transaction %d: %d versions, %d locks, %d paths", txID, versions, locks, paths)
+
+	return true, nil
+}
@@ -0,0 +1,170 @@
+package models
+
+import (
+	"context"
+	"dt/utils/log"
+	"fmt"
+)
+
+// savepoint marks how many records and lock grants the transaction had when
+// it was set
+type savepoint struct {
+	name    string
+	records int
+	grants  int
+}
+
+// lockGrant is a lock granted to the transaction, in grant order. An upgrade
+// turned a shared lock already held into an exclusive one.
+type lockGrant struct {
+	key     lockKey
+	upgrade bool
+}
+
+// Savepoint marks the current state of the transaction. A name may be reused,
+// the most recent savepoint with the name shadows the older ones.
+func (tx *Transaction) Savepoint(name string) error {
+	tx.opMu.Lock()
+	defer tx.opMu.Unlock()
+
+	if err := tx.ensureActive(); err != nil {
+		return err
+	}
+
+	tx.savepoints = append(tx.savepoints, savepoint{
+		name:    name,
+		records: len(tx.records),
+		grants:  len(tx.grants),
+	})
+	return nil
+}
+
+// RollbackTo undoes the versions written and releases the locks taken since
+// the savepoint, in reverse order. The savepoint itself is kept, savepoints
+// set after it are discarded. Read and write sets kept by the serializable
+// snapshot and optimistic modes are not shrunk, which can only cause extra
+// aborts.
+func (tx *Transaction) RollbackTo(name string) error {
+	tx.opMu.Lock()
+	defer tx.opMu.Unlock()
+
+	if err := tx.ensureActive(); err != nil {
+		return err
+	}
+
+	i, err := tx.findSavepoint(name)
+	if err != nil {
+		return err
+	}
+	sp := tx.savepoints[i]
+
+	log.Debug("Rolling back transaction %d to savepoint %s", tx.ID, name)
+
+	ctx := context.WithoutCancel(tx.ctx)
+	t, err := appConn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for j := len(tx.records) - 1; j >= sp.records; j-- {
+		if err := undoRecord(ctx, t, tx.records[j], tx.ID); err != nil {
+			t.Rollback()
+			tx.rollback()
+			return err
+		}
+	}
+	if err := t.Commit(); err != nil {
+		tx.rollback()
+		return err
+	}
+
+	tx.records = tx.records[:sp.records]
+	tx.written.Store(int64(len(tx.records)))
+	tx.savepoints = tx.savepoints[:i+1]
+
+	if err := tx.releaseGrants(ctx, sp.grants); err != nil {
+		tx.rollback()
+		return err
+	}
+	return nil
+}
+
+// Release discards the savepoint and every savepoint set after it, keeping
+// the work done since
+func (tx *Transaction) Release(name string) error {
+	tx.opMu.Lock()
+	defer tx.opMu.Unlock()
+
+	if err := tx.ensureActive(); err != nil {
+		return err
+	}
+
+	i, err := tx.findSavepoint(name)
+	if err != nil {
+		return err
+	}
+	tx.savepoints = tx.savepoints[:i]
+	return nil
+}
+
+func (tx *Transaction) findSavepoint(name string) (int, error) {
+	for i := len(tx.savepoints) - 1; i >= 0; i-- {
+		if tx.savepoints[i].name == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("savepoint %q does not exist in transaction %d", name, tx.ID)
+}
+
+// undoRecord reverts a record like rollbackRecord, except that versions
+// created by the record are deleted instead of marked as rolled back, so the
+// transaction can write the row again under the same (id, tx_min) key
+func undoRecord(ctx context.Context, t execer, r Record, txID int) error {
+	if r.Operation == OpInsert || r.Operation == OpUpdate {
+		stmt := `DELETE FROM ` + quoteIdent(r.Table) + ` WHERE id = $1 AND tx_min = $2`
+		if _, err := t.ExecContext(ctx, stmt, r.ID, txID); err != nil {
+			return err
+		}
+		if r.Operation == OpInsert {
+			return nil
+		}
+		// the version ended by the update is restored as after a delete
+		r.Operation = OpDelete
+	}
+	return rollbackRecord(ctx, t, r, txID)
+}
+
+// releaseGrants gives back the locks granted after the first n grants:
+// upgrades are downgraded to shared locks again, other locks are released
+func (tx *Transaction) releaseGrants(ctx context.Context, n int) error {
+	keys := make([]lockKey, 0, len(tx.grants)-n)
+	for j := len(tx.grants) - 1; j >= n; j-- {
+		g := tx.grants[j]
+
+		var err error
+		if g.upgrade {
+			_, err = mvccConn.ExecContext(ctx, `
+                UPDATE locks SET shared = TRUE
+                WHERE record_table = $1 AND record_id = $2 AND txid = $3`,
+				g.key.table, g.key.id, tx.ID)
+		} else {
+			_, err = mvccConn.ExecContext(ctx, `
+                DELETE FROM locks
+                WHERE record_table = $1 AND record_id = $2 AND txid = $3`,
+				g.key.table, g.key.id, tx.ID)
+		}
+		if err != nil {
+			return err
+		}
+
+		if g.upgrade {
+			tx.heldLocks[g.key] = ReadLock
+		} else {
+			delete(tx.heldLocks, g.key)
+		}
+		tx.grants = tx.grants[:j]
+		keys = append(keys, g.key)
+	}
+
+	lockQueue.wake(keys...)
+	return nil
+}
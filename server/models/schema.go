@@ -0,0 +1,218 @@
+package models
+
+import (
+	"context"
+	"dt/utils/log"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// version columns every versioned table starts with, in this order
+var versionColumns = []string{
+	"tx_min",
+	"tx_max",
+	"tx_min_committed",
+	"tx_max_committed",
+	"tx_min_rolled_back",
+	"tx_max_rolled_back",
+}
+
+// ErrUnknownTable and ErrUnknownColumn are wrapped by the IdentifierError
+// returned for a name that is not part of the schema
+var (
+	ErrUnknownTable  = errors.New("unknown table")
+	ErrUnknownColumn = errors.New("unknown column")
+)
+
+// IdentifierError reports a table, or a column of a known table, that is not
+// part of the schema. Identifiers are only ever put into SQL after passing
+// this check, and quoted.
+type IdentifierError struct {
+	Table  string
+	Column string
+	// ErrUnknownTable or ErrUnknownColumn
+	Err error
+}
+
+func (e *IdentifierError) Error() string {
+	if e.Err == ErrUnknownTable {
+		return fmt.Sprintf("%v %q", e.Err, e.Table)
+	}
+	return fmt.Sprintf("%v %q in table %q", e.Err, e.Column, e.Table)
+}
+
+func (e *IdentifierError) Unwrap() error {
+	return e.Err
+}
+
+// quoteIdent quotes a name already checked against the schema
+func quoteIdent(name string) string {
+	return pq.QuoteIdentifier(name)
+}
+
+// TableSchema describes a versioned table: the version columns, then id and
+// the data columns, with ids drawn from Sequence
+type TableSchema struct {
+	Name     string   `json:"name"`
+	Sequence string   `json:"sequence"`
+	Columns  []string `json:"columns"`
+}
+
+// schemaRegistry holds the versioned tables discovered in the app database
+type schemaRegistry struct {
+	mu     sync.RWMutex
+	tables map[string]*TableSchema
+}
+
+var schema = &schemaRegistry{tables: make(map[string]*TableSchema)}
+
+// LoadSchema discovers the versioned tables of the app database: tables
+// whose columns start with the six version columns followed by id, with an
+// <table>_id_seq sequence. Tables carrying only part of the version columns,
+// or lacking the sequence, fail the validation. Tables without any version
+// column are not versioned and are ignored.
+func LoadSchema(ctx context.Context) error {
+	rows, err := appConn.QueryContext(ctx, `
+        SELECT c.table_name, c.column_name
+        FROM information_schema.columns c
+        JOIN information_schema.tables t
+          ON t.table_schema = c.table_schema AND t.table_name = c.table_name
+        WHERE c.table_schema = current_schema()
+          AND t.table_type = 'BASE TABLE'
+          AND c.table_name <> 'schema_migrations'
+        ORDER BY c.table_name, c.ordinal_position`)
+	if err != nil {
+		return fmt.Errorf("failed to query columns: %v", err)
+	}
+	columns := make(map[string][]string)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			rows.Close()
+			return err
+		}
+		columns[table] = append(columns[table], column)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	sequences := make(map[string]bool)
+	rows, err = appConn.QueryContext(ctx, `
+        SELECT sequence_name
+        FROM information_schema.sequences
+        WHERE sequence_schema = current_schema()`)
+	if err != nil {
+		return fmt.Errorf("failed to query sequences: %v", err)
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		sequences[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tables := make(map[string]*TableSchema)
+	var problems []error
+	for table, cols := range columns {
+		versioned := 0
+		for _, col := range cols {
+			if slices.Contains(versionColumns, col) {
+				versioned++
+			}
+		}
+		if versioned == 0 {
+			continue
+		}
+
+		n := len(versionColumns)
+		switch {
+		case len(cols) <= n || !slices.Equal(cols[:n], versionColumns):
+			problems = append(problems, fmt.Errorf("table %s does not start with the version columns %v", table, versionColumns))
+		case cols[n] != "id":
+			problems = append(problems, fmt.Errorf("table %s has no id column after the version columns", table))
+		case !sequences[table+"_id_seq"]:
+			problems = append(problems, fmt.Errorf("table %s has no sequence %s_id_seq", table, table))
+		default:
+			tables[table] = &TableSchema{
+				Name:     table,
+				Sequence: table + "_id_seq",
+				Columns:  cols[n:],
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid versioned tables: %w", errors.Join(problems...))
+	}
+	if len(tables) == 0 {
+		return errors.New("no versioned tables found")
+	}
+
+	schema.mu.Lock()
+	schema.tables = tables
+	schema.mu.Unlock()
+
+	log.Info("Loaded versioned tables: %v", VersionedTables())
+	return nil
+}
+
+// VersionedTables returns the names of the versioned tables, sorted
+func VersionedTables() []string {
+	schema.mu.RLock()
+	defer schema.mu.RUnlock()
+
+	names := make([]string, 0, len(schema.tables))
+	for name := range schema.tables {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// LookupTable returns the schema of a versioned table
+func LookupTable(table string) (*TableSchema, error) {
+	schema.mu.RLock()
+	defer schema.mu.RUnlock()
+
+	ts, ok := schema.tables[table]
+	if !ok {
+		return nil, &IdentifierError{Table: table, Err: ErrUnknownTable}
+	}
+	return ts, nil
+}
+
+// Ident returns the quoted table name
+func (ts *TableSchema) Ident() string {
+	return quoteIdent(ts.Name)
+}
+
+// column returns the quoted name of a column of the table
+func (ts *TableSchema) column(name string) (string, error) {
+	if !slices.Contains(ts.Columns, name) {
+		return "", &IdentifierError{Table: ts.Name, Column: name, Err: ErrUnknownColumn}
+	}
+	return quoteIdent(name), nil
+}
+
+func (ts *TableSchema) columnList(names []string) ([]string, error) {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		column, err := ts.column(name)
+		if err != nil {
+			return nil, err
+		}
+		quoted[i] = column
+	}
+	return quoted, nil
+}
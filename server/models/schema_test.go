@@ -0,0 +1,218 @@
+package models
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// hostile identifiers seeding the fuzz targets
+var hostileIdentifiers = []string{
+	"",
+	"accounts",
+	"balance",
+	"accounts; DROP TABLE accounts; --",
+	"balance = balance OR 1=1 --",
+	`accounts" WHERE 1=1; --`,
+	`"balance"`,
+	`""`,
+	"id) VALUES (1); --",
+	"users.username",
+	"public.accounts",
+	"ACCOUNTS",
+	"accounts\x00users",
+	"balance\n--",
+	"$1",
+	"tx_min",
+	"pg_catalog.pg_user",
+	"ünïcødé",
+}
+
+// testSchema is the schema of the app migrations, installed when the tests
+// run without a database
+var testSchema = map[string]*TableSchema{
+	"users":    {Name: "users", Sequence: "users_id_seq", Columns: []string{"id", "username"}},
+	"accounts": {Name: "accounts", Sequence: "accounts_id_seq", Columns: []string{"id", "user_id", "balance"}},
+	"audit":    {Name: "audit", Sequence: "audit_id_seq", Columns: []string{"id", "timestamp", "operation", "user_id"}},
+}
+
+func useTestSchema(tb testing.TB) {
+	tb.Helper()
+
+	schema.mu.Lock()
+	defer schema.mu.Unlock()
+	if len(schema.tables) > 0 {
+		return
+	}
+	schema.tables = testSchema
+	tb.Cleanup(func() {
+		schema.mu.Lock()
+		schema.tables = make(map[string]*TableSchema)
+		schema.mu.Unlock()
+	})
+}
+
+func FuzzLookupTable(f *testing.F) {
+	useTestSchema(f)
+	for _, s := range hostileIdentifiers {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, table string) {
+		ts, err := LookupTable(table)
+		if slices.Contains(VersionedTables(), table) {
+			if err != nil || ts.Name != table {
+				t.Fatalf("LookupTable(%q) = %v, %v", table, ts, err)
+			}
+			return
+		}
+		var identErr *IdentifierError
+		if !errors.As(err, &identErr) || !errors.Is(err, ErrUnknownTable) || identErr.Table != table {
+			t.Fatalf("LookupTable(%q) returned %v, want an unknown table error", table, err)
+		}
+	})
+}
+
+func FuzzColumn(f *testing.F) {
+	useTestSchema(f)
+	for _, s := range hostileIdentifiers {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, column string) {
+		ts, err := LookupTable("accounts")
+		if err != nil {
+			t.Fatal(err)
+		}
+		quoted, err := ts.column(column)
+		if slices.Contains(ts.Columns, column) {
+			if err != nil || quoted != quoteIdent(column) {
+				t.Fatalf("column(%q) = %q, %v", column, quoted, err)
+			}
+			return
+		}
+		if !errors.Is(err, ErrUnknownColumn) || quoted != "" {
+			t.Fatalf("column(%q) = %q, %v, want an unknown column error", column, quoted, err)
+		}
+		if _, err := ts.columnList([]string{"balance", column}); !errors.Is(err, ErrUnknownColumn) {
+			t.Fatalf("columnList with %q returned %v, want an unknown column error", column, err)
+		}
+	})
+}
+
+// FuzzQuoteIdent checks that a quoted identifier is a single double-quoted
+// token that unquotes to the name. Like PostgreSQL, quoting drops everything
+// from a NUL byte on.
+func FuzzQuoteIdent(f *testing.F) {
+	for _, s := range hostileIdentifiers {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, name string) {
+		quoted := quoteIdent(name)
+		if len(quoted) < 2 || quoted[0] != '"' || quoted[len(quoted)-1] != '"' {
+			t.Fatalf("quoteIdent(%q) = %q is not double-quoted", name, quoted)
+		}
+		inner := quoted[1 : len(quoted)-1]
+		if strings.Count(inner, `"`) != 2*strings.Count(inner, `""`) {
+			t.Fatalf("quoteIdent(%q) = %q has an unescaped quote", name, quoted)
+		}
+
+		want, _, _ := strings.Cut(name, "\x00")
+		if got := strings.ReplaceAll(inner, `""`, `"`); got != want {
+			t.Fatalf("quoteIdent(%q) unquotes to %q, want %q", name, got, want)
+		}
+	})
+}
+
+// fuzzIdentifiers feeds table and column names to call, which passes them to
+// a Transaction method. Known names are skipped so nothing is written, every
+// other name must be rejected with an IdentifierError without aborting the
+// transaction.
+func fuzzIdentifiers(f *testing.F, call func(tx *Transaction, table, column string) error) {
+	fuzzNames(f, true, call)
+}
+
+// fuzzTables is fuzzIdentifiers for methods that only take a table
+func fuzzTables(f *testing.F, call func(tx *Transaction, table string) error) {
+	fuzzNames(f, false, func(tx *Transaction, table, _ string) error {
+		return call(tx, table)
+	})
+}
+
+func fuzzNames(f *testing.F, takesColumn bool, call func(tx *Transaction, table, column string) error) {
+	openTestDB(f)
+	for _, s := range hostileIdentifiers {
+		f.Add(s, "balance")
+		f.Add("accounts", s)
+	}
+
+	tx := mustOpenTx(f)
+	f.Fuzz(func(t *testing.T, table, column string) {
+		ts, err := LookupTable(table)
+		if err == nil && (!takesColumn || column == "" || slices.Contains(ts.Columns, column)) {
+			t.Skip("known identifiers")
+		}
+		want := ErrUnknownTable
+		if err == nil {
+			want = ErrUnknownColumn
+		}
+
+		err = call(tx, table, column)
+		var identErr *IdentifierError
+		if !errors.As(err, &identErr) || !errors.Is(err, want) {
+			t.Fatalf("table %q, column %q: got %v, want %v", table, column, err, want)
+		}
+		if err := tx.ensureActive(); err != nil {
+			t.Fatalf("table %q, column %q: %v", table, column, err)
+		}
+	})
+}
+
+func FuzzWhere(f *testing.F) {
+	fuzzIdentifiers(f, func(tx *Transaction, table, column string) error {
+		_, err := tx.Where(table, column, 1)
+		return err
+	})
+}
+
+func FuzzSelectByColumn(f *testing.F) {
+	fuzzIdentifiers(f, func(tx *Transaction, table, column string) error {
+		_, err := tx.SelectByColumn(table, column, 1)
+		return err
+	})
+}
+
+func FuzzWhereAsOf(f *testing.F) {
+	fuzzIdentifiers(f, func(tx *Transaction, table, column string) error {
+		_, err := tx.WhereAsOf(table, tx.ID, column, 1)
+		return err
+	})
+}
+
+func FuzzInsert(f *testing.F) {
+	fuzzIdentifiers(f, func(tx *Transaction, table, column string) error {
+		_, err := tx.Insert(table, []string{"user_id", column}, 1, 1)
+		return err
+	})
+}
+
+func FuzzUpdate(f *testing.F) {
+	fuzzIdentifiers(f, func(tx *Transaction, table, column string) error {
+		return tx.Update(table, 1, []string{column}, 1)
+	})
+}
+
+func FuzzDelete(f *testing.F) {
+	fuzzTables(f, func(tx *Transaction, table string) error {
+		return tx.Delete(table, 1)
+	})
+}
+
+func FuzzHistory(f *testing.F) {
+	fuzzTables(f, func(tx *Transaction, table string) error {
+		_, err := tx.History(table, 1)
+		return err
+	})
+}
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"context"
+
+	"github.com/lib/pq"
+)
+
+// Snapshot captures which transactions had committed when it was taken:
+// every transaction below XMax that was not in progress. Transactions from
+// XMax on started later and are never visible.
+type Snapshot struct {
+	XMin       int          `json:"xmin"`
+	XMax       int          `json:"xmax"`
+	InProgress map[int]bool `json:"-"`
+}
+
+// takeSnapshot records the transactions in progress, txID excluded. A
+// snapshot taken when txID starts ends at txID itself, later statement
+// snapshots also cover the transactions started since. IDs are allocated
+// before their rows are written, so opening IDs are counted in progress too.
+func takeSnapshot(ctx context.Context, txID int, atStart bool) (*Snapshot, error) {
+	opening := txIDs.openingIDs()
+
+	var next int
+	var active pq.Int64Array
+	err := mvccConn.QueryRowContext(ctx, `
+        SELECT COALESCE((SELECT MAX(id) FROM transactions), 0) + 1,
+               ARRAY(SELECT id FROM transactions WHERE status = $1 AND id <> $2)`,
+		TxActive, txID).Scan(&next, &active)
+	if err != nil {
+		return nil, err
+	}
+
+	xmax := next
+	if atStart {
+		xmax = txID
+	}
+
+	snapshot := &Snapshot{
+		XMin:       xmax,
+		XMax:       xmax,
+		InProgress: make(map[int]bool),
+	}
+	for _, id := range active {
+		snapshot.addInProgress(int(id))
+	}
+	// transactions whose row is not written yet
+	for _, id := range opening {
+		if id != txID {
+			snapshot.addInProgress(id)
+		}
+	}
+	return snapshot, nil
+}
+
+func (s *Snapshot) addInProgress(txID int) {
+	if txID >= s.XMax {
+		return
+	}
+	s.InProgress[txID] = true
+	s.XMin = min(s.XMin, txID)
+}
+
+// finishedBefore reports whether txID had finished when the snapshot was
+// taken, the version flags then tell whether it committed or rolled back
+func (s *Snapshot) finishedBefore(txID int) bool {
+	if txID < s.XMin {
+		return true
+	}
+	return txID < s.XMax && !s.InProgress[txID]
+}
+
+// beginStatement takes a fresh snapshot for the statement under read
+// committed, other levels keep the snapshot of the transaction start
+func (tx *Transaction) beginStatement() error {
+	if tx.isolation != ReadCommitted {
+		return nil
+	}
+
+	snapshot, err := takeSnapshot(tx.ctx, tx.ID, false)
+	if err != nil {
+		return err
+	}
+	tx.setSnapshot(snapshot)
+	return nil
+}
+
+func (tx *Transaction) setSnapshot(snapshot *Snapshot) {
+	tx.snapshot = snapshot
+	tx.xmin.Store(int64(snapshot.XMin))
+	if tx.readOnly {
+		readOnlySnapshots.set(tx, snapshot)
+	}
+}
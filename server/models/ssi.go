@@ -0,0 +1,274 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+)
+
+// predicate read by a query: rows of table whose column equals value, or
+// every row of the table when column is empty
+type predicate struct {
+	table  string
+	column string
+	value  string
+}
+
+func (p predicate) matches(table string, values map[string]string) bool {
+	if p.table != table {
+		return false
+	}
+	if p.column == "" {
+		return true
+	}
+	value, ok := values[p.column]
+	return ok && value == p.value
+}
+
+// ssiTx is the read and write set of a transaction running under
+// SerializableSnapshot, kept after commit for as long as transactions
+// concurrent with it are running
+type ssiTx struct {
+	id         int
+	snapshot   *Snapshot
+	reads      map[lockKey]bool
+	predicates []predicate
+	// written rows with the column values they were given
+	writes map[lockKey]map[string]string
+
+	inConflict  bool
+	outConflict bool
+	doomed      bool
+	committed   bool
+}
+
+// concurrentWith reports whether neither transaction had finished when the
+// other one started
+func (t *ssiTx) concurrentWith(other *ssiTx) bool {
+	return !t.snapshot.finishedBefore(other.id) && !other.snapshot.finishedBefore(t.id)
+}
+
+func (t *ssiTx) isPivot() bool {
+	return t.inConflict && t.outConflict
+}
+
+// ssiManager tracks rw-antidependencies between SerializableSnapshot
+// transactions. A rw-antidependency R -> W exists when R read a version that
+// a concurrent W replaced, or missed a row W wrote. A transaction with both
+// an incoming and an outgoing one is the pivot of a dangerous structure, the
+// only shape a non-serializable execution under snapshot isolation can take,
+// and is aborted. This is conservative: some serializable executions abort.
+type ssiManager struct {
+	mu  sync.Mutex
+	txs map[int]*ssiTx
+}
+
+var ssi = &ssiManager{txs: make(map[int]*ssiTx)}
+
+func (m *ssiManager) register(tx *Transaction) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.txs[tx.ID] = &ssiTx{
+		id:       tx.ID,
+		snapshot: tx.snapshot,
+		reads:    make(map[lockKey]bool),
+		writes:   make(map[lockKey]map[string]string),
+	}
+}
+
+// read records a query of pred that returned the rows ids, adding a conflict
+// towards every concurrent transaction that wrote one of them or a row
+// matching the predicate
+func (m *ssiManager) read(txID int, pred predicate, ids []int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reader, ok := m.txs[txID]
+	if !ok {
+		return nil
+	}
+
+	reader.predicates = append(reader.predicates, pred)
+	for _, id := range ids {
+		reader.reads[lockKey{table: pred.table, id: id}] = true
+	}
+
+	for _, writer := range m.txs {
+		if writer == reader || !reader.concurrentWith(writer) {
+			continue
+		}
+		for key, values := range writer.writes {
+			if reader.reads[key] || pred.matches(key.table, values) {
+				if err := m.addConflict(reader, writer, reader); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// write records a write of a row, adding a conflict from every concurrent
+// transaction that read the row or queried a predicate the row matches
+func (m *ssiManager) write(txID int, key lockKey, values map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writer, ok := m.txs[txID]
+	if !ok {
+		return nil
+	}
+	recordWrite(writer.writes, key, values)
+	values = writer.writes[key]
+
+	for _, reader := range m.txs {
+		if reader == writer || !writer.concurrentWith(reader) {
+			continue
+		}
+
+		conflict := reader.reads[key]
+		for _, pred := range reader.predicates {
+			conflict = conflict || pred.matches(key.table, values)
+		}
+		if conflict {
+			if err := m.addConflict(reader, writer, writer); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addConflict records the rw-antidependency reader -> writer. A pivot still
+// running is doomed to abort at commit; if the pivot already committed, the
+// current transaction has to abort instead.
+func (m *ssiManager) addConflict(reader, writer, current *ssiTx) error {
+	reader.outConflict = true
+	writer.inConflict = true
+
+	for _, t := range []*ssiTx{reader, writer} {
+		if !t.isPivot() {
+			continue
+		}
+		if t.committed {
+			return fmt.Errorf("%w: tx %d conflicts with committed pivot tx %d", ErrSerializationFailure, current.id, t.id)
+		}
+		t.doomed = true
+	}
+	return nil
+}
+
+// commit validates the transaction before it commits
+func (m *ssiManager) commit(txID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.txs[txID]
+	if !ok {
+		return nil
+	}
+	if t.doomed || t.isPivot() {
+		return fmt.Errorf("%w: tx %d is the pivot of a dangerous structure", ErrSerializationFailure, txID)
+	}
+	t.committed = true
+	return nil
+}
+
+// finish drops a transaction that did not commit and every committed one that
+// no running transaction is concurrent with anymore
+func (m *ssiManager) finish(txID int, committed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !committed {
+		delete(m.txs, txID)
+	}
+
+	for id, t := range m.txs {
+		if !t.committed {
+			continue
+		}
+		needed := false
+		for _, other := range m.txs {
+			if !other.committed && other.concurrentWith(t) {
+				needed = true
+				break
+			}
+		}
+		if !needed {
+			delete(m.txs, id)
+		}
+	}
+}
+
+// recordWrite adds the values written to a row to those it was given earlier
+// in the same transaction
+func recordWrite(writes map[lockKey]map[string]string, key lockKey, values map[string]string) {
+	merged := make(map[string]string, len(values))
+	for column, value := range writes[key] {
+		merged[column] = value
+	}
+	for column, value := range values {
+		merged[column] = value
+	}
+	writes[key] = merged
+}
+
+// trackRead records a query in the read set of a SerializableSnapshot or
+// optimistic transaction
+func (tx *Transaction) trackRead(table, column string, value any, results []map[string]interface{}) error {
+	if tx.readOnly || (tx.isolation != SerializableSnapshot && tx.scheduler != OptimisticScheduler) {
+		return nil
+	}
+
+	ids := make([]int, 0, len(results))
+	for _, result := range results {
+		if id, ok := result["id"].(int64); ok {
+			ids = append(ids, int(id))
+		}
+	}
+
+	pred := predicate{table: table, column: column}
+	if column != "" {
+		pred.value = fmt.Sprint(value)
+	}
+
+	if tx.scheduler == OptimisticScheduler {
+		occ.read(tx.ID, pred, ids)
+	}
+	if tx.isolation == SerializableSnapshot {
+		if err := ssi.read(tx.ID, pred, ids); err != nil {
+			tx.rollback()
+			return err
+		}
+	}
+	return nil
+}
+
+// trackWrite records a written row in the write set of a
+// SerializableSnapshot or optimistic transaction
+func (tx *Transaction) trackWrite(table string, id int, fields []string, values []any) error {
+	if tx.isolation != SerializableSnapshot && tx.scheduler != OptimisticScheduler {
+		return nil
+	}
+
+	written := map[string]string{"id": fmt.Sprint(id)}
+	for i, field := range fields {
+		if i < len(values) {
+			written[field] = fmt.Sprint(values[i])
+		}
+	}
+	key := lockKey{table: table, id: id}
+
+	if tx.scheduler == OptimisticScheduler {
+		occ.write(tx.ID, key, written)
+	}
+	if tx.isolation == SerializableSnapshot {
+		if err := ssi.write(tx.ID, key, written); err != nil {
+			tx.rollback()
+			return err
+		}
+	}
+	return nil
+}
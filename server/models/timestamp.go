@@ -0,0 +1,309 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"dt/utils/log"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Scheduler selects the concurrency control used by a transaction
+type Scheduler string
+
+const (
+	// two-phase locking, the default
+	LockingScheduler Scheduler = "locking"
+	// basic timestamp ordering: operations arriving too late abort
+	TimestampOrdering Scheduler = "timestamp"
+	// timestamp ordering with the Thomas write rule: obsolete writes are
+	// skipped instead of aborting
+	ThomasWriteRule Scheduler = "thomas"
+	// optimistic concurrency control: no locks are taken, reads and writes
+	// are recorded and validated at commit
+	OptimisticScheduler Scheduler = "optimistic"
+)
+
+func (s Scheduler) Validate() error {
+	switch s {
+	case LockingScheduler, TimestampOrdering, ThomasWriteRule, OptimisticScheduler:
+		return nil
+	default:
+		return fmt.Errorf("unknown scheduler %q", s)
+	}
+}
+
+// OrdersTimestamps reports whether the scheduler orders transactions by
+// timestamp, in which case a restarted transaction needs a new one
+func (s Scheduler) OrdersTimestamps() bool {
+	return s == TimestampOrdering || s == ThomasWriteRule
+}
+
+func WithScheduler(scheduler Scheduler) TxOption {
+	return func(tx *Transaction) {
+		tx.scheduler = scheduler
+	}
+}
+
+// itemTimestamps is the ordering state of a row. writeTx wrote the version
+// with timestamp writeTs, it holds the row until it commits or rolls back,
+// which restores the previous writer.
+type itemTimestamps struct {
+	readTs         int64
+	writeTs        int64
+	writeTx        int
+	writeCommitted bool
+}
+
+// pendingWriter returns the transaction other than tx holding the row with
+// an uncommitted write, or 0
+func (it itemTimestamps) pendingWriter(tx *Transaction) int {
+	if it.writeCommitted || it.writeTx == tx.ID {
+		return 0
+	}
+	return it.writeTx
+}
+
+// lockItemTimestamps reads the ordering state of a row within t, creating it
+// when the row has none, and locks it until t ends
+func lockItemTimestamps(tx *Transaction, t *sql.Tx, table string, id int) (itemTimestamps, error) {
+	var it itemTimestamps
+	_, err := t.ExecContext(tx.ctx, `
+        INSERT INTO item_timestamps (record_table, record_id)
+        VALUES ($1, $2)
+        ON CONFLICT (record_table, record_id) DO NOTHING`,
+		table, id)
+	if err != nil {
+		return it, err
+	}
+
+	err = t.QueryRowContext(tx.ctx, `
+        SELECT read_ts, write_ts, write_tx, write_committed
+        FROM item_timestamps
+        WHERE record_table = $1 AND record_id = $2
+        FOR UPDATE`,
+		table, id).Scan(&it.readTs, &it.writeTs, &it.writeTx, &it.writeCommitted)
+	return it, err
+}
+
+// checkRead applies the timestamp ordering read rule to every returned row: a
+// row written by a younger transaction cannot be read, otherwise its read
+// timestamp is advanced to the transaction's timestamp. A read meeting the
+// uncommitted write of an older transaction waits for it to finish, and the
+// read is aborted when it returned a version older than the committed write.
+// Read-only transactions read their snapshot and are not ordered.
+func (tx *Transaction) checkRead(table string, results []map[string]interface{}) error {
+	if !tx.scheduler.OrdersTimestamps() || tx.readOnly {
+		return nil
+	}
+
+	for _, result := range results {
+		id, ok := result["id"].(int64)
+		if !ok {
+			continue
+		}
+
+		for {
+			writer, err := tx.orderRead(table, int(id))
+			if err == nil && writer != 0 {
+				err = tx.waitForWriter(writer)
+			}
+			if err != nil {
+				tx.rollback()
+				return err
+			}
+			if writer == 0 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// orderRead applies the read rule to a row, or returns the older transaction
+// whose uncommitted write the read must wait for
+func (tx *Transaction) orderRead(table string, id int) (int, error) {
+	t, err := mvccConn.BeginTx(tx.ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer t.Rollback()
+
+	it, err := lockItemTimestamps(tx, t, table, id)
+	if err != nil {
+		return 0, err
+	}
+
+	if tx.timestamp < it.writeTs && it.writeTx != tx.ID {
+		return 0, fmt.Errorf("%w: tx %d read %s_%d after a younger write", ErrTimestampOrder, tx.ID, table, id)
+	}
+	if writer := it.pendingWriter(tx); writer != 0 {
+		return writer, nil
+	}
+	// the snapshot predates the commit of the latest write, the read
+	// returned an older version
+	if it.writeTx != 0 && it.writeTx != tx.ID && !tx.snapshot.finishedBefore(it.writeTx) {
+		return 0, fmt.Errorf("%w: tx %d read %s_%d before the commit of tx %d", ErrTimestampOrder, tx.ID, table, id, it.writeTx)
+	}
+
+	_, err = t.ExecContext(tx.ctx, `
+        UPDATE item_timestamps SET read_ts = GREATEST(read_ts, $3)
+        WHERE record_table = $1 AND record_id = $2`,
+		table, id, tx.timestamp)
+	if err != nil {
+		return 0, err
+	}
+	return 0, t.Commit()
+}
+
+// checkWrite applies the timestamp ordering write rule: a row read by a
+// younger transaction cannot be written, and neither can a row written by a
+// younger transaction, unless the Thomas write rule allows the write to be
+// skipped as obsolete. It reports whether the write must be skipped. Only
+// committed writes make a write obsolete, a write meeting the uncommitted
+// write of an older transaction waits for it to finish. Otherwise tx becomes
+// the uncommitted writer of the row.
+func (tx *Transaction) checkWrite(table string, id int) (bool, error) {
+	if !tx.scheduler.OrdersTimestamps() {
+		return false, nil
+	}
+
+	for {
+		skip, writer, err := tx.orderWrite(table, id)
+		if err != nil || writer == 0 {
+			return skip, err
+		}
+		if err := tx.waitForWriter(writer); err != nil {
+			return false, err
+		}
+	}
+}
+
+// orderWrite applies the write rule to a row, or returns the older
+// transaction whose uncommitted write tx must wait for
+func (tx *Transaction) orderWrite(table string, id int) (bool, int, error) {
+	t, err := mvccConn.BeginTx(tx.ctx, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	defer t.Rollback()
+
+	it, err := lockItemTimestamps(tx, t, table, id)
+	if err != nil {
+		return false, 0, err
+	}
+
+	if tx.timestamp < it.readTs {
+		return false, 0, fmt.Errorf("%w: tx %d wrote %s_%d after a younger read", ErrTimestampOrder, tx.ID, table, id)
+	}
+	if it.writeTx == tx.ID {
+		return false, 0, nil
+	}
+	if tx.timestamp < it.writeTs {
+		if tx.scheduler == ThomasWriteRule && it.writeCommitted {
+			log.Debug("Skipping obsolete write of %s_%d by tx %d", table, id, tx.ID)
+			return true, 0, nil
+		}
+		return false, 0, fmt.Errorf("%w: tx %d wrote %s_%d after a younger write", ErrTimestampOrder, tx.ID, table, id)
+	}
+	if writer := it.pendingWriter(tx); writer != 0 {
+		return false, writer, nil
+	}
+
+	_, err = t.ExecContext(tx.ctx, `
+        UPDATE item_timestamps
+        SET prev_write_ts = write_ts, prev_write_tx = write_tx,
+            write_ts = $3, write_tx = $4, write_committed = FALSE
+        WHERE record_table = $1 AND record_id = $2`,
+		table, id, tx.timestamp, tx.ID)
+	if err != nil {
+		return false, 0, err
+	}
+	return false, 0, t.Commit()
+}
+
+// waitForWriter waits until the transaction writer has committed or rolled
+// back. Transactions only wait for older ones, so the waits cannot form a
+// cycle. Writers running in this process are watched, others are polled.
+func (tx *Transaction) waitForWriter(writer int) error {
+	log.Debug("Tx %d waiting for the uncommitted write of tx %d", tx.ID, writer)
+
+	var done <-chan struct{}
+	if w, ok := liveTxs.get(writer); ok {
+		done = w.ctx.Done()
+	}
+
+	timeout := time.NewTimer(tx.lockTimeout)
+	defer timeout.Stop()
+	poll := time.NewTicker(lockPollInterval)
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-done:
+			// the context also ends before an asynchronous rollback
+			if _, ok := liveTxs.get(writer); !ok {
+				return nil
+			}
+			done = nil
+		case <-poll.C:
+			var status string
+			err := mvccConn.QueryRowContext(tx.ctx,
+				`SELECT status FROM transactions WHERE id = $1`, writer).Scan(&status)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			if status != TxActive {
+				return nil
+			}
+		case <-timeout.C:
+			return fmt.Errorf("%w: waited %v for the write of tx %d", ErrLockTimeout, tx.lockTimeout, writer)
+		case err := <-tx.abortCh:
+			return err
+		case <-tx.ctx.Done():
+			return tx.ctxErr()
+		}
+	}
+}
+
+// commitWriteTimestamps commits the writes of the transaction to the
+// ordering state, as part of its commit. Rows it claimed without leaving a
+// version, e.g. written before a rolled back savepoint, get their previous
+// writer back.
+func (tx *Transaction) commitWriteTimestamps(mvcc execer) error {
+	if !tx.scheduler.OrdersTimestamps() {
+		return nil
+	}
+
+	tables := make([]string, 0, len(tx.records))
+	ids := make([]int64, 0, len(tx.records))
+	for _, r := range tx.records {
+		tables = append(tables, r.Table)
+		ids = append(ids, int64(r.ID))
+	}
+
+	_, err := mvcc.ExecContext(tx.ctx, `
+        UPDATE item_timestamps SET write_committed = TRUE
+        WHERE write_tx = $1 AND NOT write_committed
+          AND (record_table, record_id) IN (SELECT * FROM unnest($2::text[], $3::int[]))`,
+		tx.ID, pq.Array(tables), pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	return restoreWriteTimestamps(tx.ctx, mvcc, tx.ID)
+}
+
+// restoreWriteTimestamps undoes the uncommitted writes of txID to the
+// ordering state. No other transaction writes a row before they are undone,
+// so the previous writer is still the latest committed one.
+func restoreWriteTimestamps(ctx context.Context, mvcc execer, txID int) error {
+	_, err := mvcc.ExecContext(ctx, `
+        UPDATE item_timestamps
+        SET write_ts = prev_write_ts, write_tx = prev_write_tx, write_committed = TRUE
+        WHERE write_tx = $1 AND NOT write_committed`,
+		txID)
+	return err
+}
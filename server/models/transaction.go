@@ -11,9 +11,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/lib/pq"
 )
 
 type TransactionData struct {
@@ -26,11 +25,35 @@ type Transaction struct {
 	TransactionData
 	records   []Record
 	ctx       context.Context
+	cancel    context.CancelFunc
 	timestamp int64
+	isolation IsolationLevel
+	scheduler Scheduler
+	snapshot  *Snapshot
+	// XMin of the current snapshot, read by vacuum
+	xmin atomic.Int64
+
+	deadline time.Time
+	// stops the rollback scheduled for when ctx ends
+	stopWatch func() bool
+
+	heldLocks   map[lockKey]LockType
+	grants      []lockGrant
+	lockTimeout time.Duration
+	savepoints  []savepoint
+
+	priority int
+	readOnly bool
+	written  atomic.Int64
+	abortCh  chan error
+
+	// serializes the operations of the transaction with an asynchronous
+	// rollback after it has been wounded
+	opMu     sync.Mutex
+	abortMu  sync.Mutex
+	abortErr error
 }
 
-var mu sync.Mutex
-
 const operationDelay = 200 * time.Millisecond
 
 // fetches transaction data
@@ -44,57 +67,175 @@ func GetTx(ctx context.Context, txID int) (*TransactionData, error) {
 	return t, nil
 }
 
-// create new transaction (insert into table)
-func OpenTx(ctx context.Context) (*Transaction, error) {
-	mu.Lock()
-	defer mu.Unlock()
+// create new transaction (insert into table). The ID comes from the
+// in-process allocator and the row is written in a single statement, so
+// concurrent calls do not wait for each other.
+func OpenTx(ctx context.Context, opts ...TxOption) (*Transaction, error) {
+	tx := &Transaction{
+		timestamp:   time.Now().UnixNano(),
+		records:     make([]Record, 0),
+		isolation:   RepeatableRead,
+		scheduler:   LockingScheduler,
+		heldLocks:   make(map[lockKey]LockType),
+		lockTimeout: defaultLockTimeout,
+		abortCh:     make(chan error, 1),
+	}
+	for _, opt := range opts {
+		opt(tx)
+	}
+	if err := tx.isolation.Validate(); err != nil {
+		return nil, err
+	}
 
-	timestamp := time.Now().UnixNano()
-	var id int
+	id, err := txIDs.next(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate transaction id: %v", err)
+	}
 
-	stmt := "INSERT INTO transactions (status, timestamp) VALUES ($1, $2) RETURNING id"
-	err := mvccConn.QueryRowContext(ctx, stmt, TxActive, timestamp).Scan(&id)
+	stmt := "INSERT INTO transactions (id, status, timestamp) VALUES ($1, $2, $3) RETURNING created_at"
+	err = mvccConn.QueryRowContext(ctx, stmt, id, TxActive, tx.timestamp).Scan(&tx.CreatedAt)
+	txIDs.opened(id)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create transaction: %v", err)
 	}
+	tx.ID = id
+	tx.Status = TxActive
+
+	if tx.scheduler == OptimisticScheduler {
+		occ.register(id)
+	}
 
-	txData, err := GetTx(ctx, id)
+	snapshot, err := takeSnapshot(ctx, id, true)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get transaction data: %v", err)
+		discardTx(ctx, id)
+		return nil, fmt.Errorf("failed to take snapshot: %v", err)
 	}
+	tx.setSnapshot(snapshot)
 
-	tx := &Transaction{
-		TransactionData: *txData,
-		ctx:             ctx,
-		timestamp:       timestamp,
-		records:         make([]Record, 0),
+	tx.watch(ctx)
+	liveTxs.add(tx)
+	if tx.isolation == SerializableSnapshot {
+		ssi.register(tx)
 	}
 
 	return tx, nil
 }
 
-func (tx *Transaction) IsRowVisible(row *RecordData) bool {
-	if row.TxMin > tx.ID || row.TxMinRolledBack {
-		// row inserted after current transaction & insert aborted
+// discardTx rolls back the row of a transaction that failed to open, so it
+// does not hold back snapshots and vacuum until the reaper finds it
+func discardTx(ctx context.Context, txID int) {
+	occ.finish(txID)
+
+	stmt := `UPDATE transactions SET status = $1 WHERE id = $2;`
+	if _, err := mvccConn.ExecContext(context.WithoutCancel(ctx), stmt, TxRolledBack, txID); err != nil {
+		log.Error("Failed to roll back transaction %d: %v", txID, err)
+	}
+}
+
+// watch derives tx.ctx from ctx and the deadline, and rolls the transaction
+// back when it ends before the transaction does
+func (tx *Transaction) watch(ctx context.Context) {
+	if tx.deadline.IsZero() {
+		tx.ctx, tx.cancel = context.WithCancel(ctx)
+	} else {
+		tx.ctx, tx.cancel = context.WithDeadline(ctx, tx.deadline)
+	}
+	tx.stopWatch = context.AfterFunc(tx.ctx, tx.abandon)
+}
+
+// Timestamp returns the start timestamp of the transaction
+func (tx *Transaction) Timestamp() int64 {
+	return tx.timestamp
+}
+
+// AbortReason returns the error the transaction was aborted with by another
+// transaction, or nil
+func (tx *Transaction) AbortReason() error {
+	tx.abortMu.Lock()
+	defer tx.abortMu.Unlock()
+	return tx.abortErr
+}
+
+// setAbort records the abort reason, it reports false when the transaction
+// was already aborted
+func (tx *Transaction) setAbort(err error) bool {
+	tx.abortMu.Lock()
+	defer tx.abortMu.Unlock()
+	if tx.abortErr != nil {
 		return false
 	}
-	if row.TxMin < tx.ID && !row.TxMinCommitted {
-		// row created by a concurrent transaction
+	tx.abortErr = err
+	return true
+}
+
+// wound aborts the transaction from another goroutine: its context is
+// cancelled so blocked statements stop, and it is rolled back asynchronously
+// as soon as its current operation returns
+func (tx *Transaction) wound(err error) {
+	if !tx.setAbort(err) {
+		return
+	}
+	log.Info("Transaction %d wounded: %v", tx.ID, err)
+
+	// the watch on tx.ctx rolls the transaction back
+	tx.cancel()
+}
+
+// ctxErr explains why tx.ctx is done
+func (tx *Transaction) ctxErr() error {
+	if err := tx.AbortReason(); err != nil {
+		return err
+	}
+	if errors.Is(tx.ctx.Err(), context.DeadlineExceeded) && !tx.deadline.IsZero() {
+		return ErrTxExpired
+	}
+	return tx.ctx.Err()
+}
+
+// IsRowVisible evaluates a row version against the transaction's snapshot:
+// it must have been created by the transaction itself or by one committed
+// before the snapshot, and not be deleted by either of them.
+func (tx *Transaction) IsRowVisible(row *RecordData) bool {
+	if row.TxMinRolledBack {
+		// insert aborted
 		return false
 	}
-	if row.TxMax < tx.ID && row.TxMaxCommitted {
-		// row deleted by a concurrent transaction
+	if row.TxMin != tx.ID && !(row.TxMinCommitted && tx.snapshot.finishedBefore(row.TxMin)) {
+		// row created by a concurrent or later transaction
 		return false
 	}
+	if row.TxMax == 0 || row.TxMaxRolledBack {
+		return true
+	}
 	if row.TxMax == tx.ID {
 		// row deleted by current transaction
 		return false
 	}
-	return true
+	// row deleted by a transaction committed before the snapshot
+	return !(row.TxMaxCommitted && tx.snapshot.finishedBefore(row.TxMax))
 }
 
 func (tx *Transaction) SelectByColumn(table string, column string, value any) ([]map[string]interface{}, error) {
-	query := fmt.Sprintf(`SELECT * FROM %s WHERE %s = $1`, table, column)
+	tx.opMu.Lock()
+	defer tx.opMu.Unlock()
+
+	ts, err := LookupTable(table)
+	if err != nil {
+		return nil, err
+	}
+	col, err := ts.column(column)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.lockTableForRead(table); err != nil {
+		return nil, err
+	}
+	if err := tx.beginStatement(); err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`SELECT * FROM %s WHERE %s = $1 AND NOT tx_min_rolled_back ORDER BY id, tx_min DESC`, ts.Ident(), col)
 
 	log.Info("%v", query)
 	log.Debug("Executing query: %s with args: [%v, %v]", query, tx.ID, value)
@@ -106,12 +247,57 @@ func (tx *Transaction) SelectByColumn(table string, column string, value any) ([
 	defer rows.Close()
 	log.Debug("Query executed successfully, returned")
 
-	cols, err := rows.Columns()
+	results, err := tx.scanVisible(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("Query returned %d results", len(results))
+
+	if err := tx.lockRowsForRead(table, results); err != nil {
+		return nil, err
+	}
+	if err := tx.checkRead(table, results); err != nil {
+		return nil, err
+	}
+	if err := tx.trackRead(table, column, value, results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// rowVersion is a row version as stored, with its version columns parsed
+type rowVersion struct {
+	meta RecordData
+	data map[string]interface{}
+}
+
+// scanVisible reads the row versions returned by a query and keeps the data
+// columns of those visible to the transaction's snapshot
+func (tx *Transaction) scanVisible(rows *sql.Rows) ([]map[string]interface{}, error) {
+	versions, err := scanVersions(rows)
 	if err != nil {
 		return nil, err
 	}
 
 	var results []map[string]interface{}
+	for _, v := range versions {
+		if tx.IsRowVisible(&v.meta) {
+			results = append(results, v.data)
+		}
+	}
+	return results, nil
+}
+
+// scanVersions reads every row version returned by a query, the six version
+// columns come first
+func scanVersions(rows *sql.Rows) ([]rowVersion, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []rowVersion
 	for rows.Next() {
 		row := make([]interface{}, len(cols))
 		for i := range row {
@@ -123,6 +309,25 @@ func (tx *Transaction) SelectByColumn(table string, column string, value any) ([
 			return nil, err
 		}
 
+		base := RecordData{}
+		for i, col := range cols {
+			sv := reflect.Indirect(reflect.ValueOf(row[i])).Elem()
+			switch col {
+			case "tx_min":
+				base.TxMin = int(sv.Int())
+			case "tx_max":
+				base.TxMax = int(sv.Int())
+			case "tx_min_committed":
+				base.TxMinCommitted = sv.Bool()
+			case "tx_max_committed":
+				base.TxMaxCommitted = sv.Bool()
+			case "tx_min_rolled_back":
+				base.TxMinRolledBack = sv.Bool()
+			case "tx_max_rolled_back":
+				base.TxMaxRolledBack = sv.Bool()
+			}
+		}
+
 		result := make(map[string]interface{})
 		for i, col := range cols[6:] {
 			sv := reflect.Indirect(reflect.ValueOf(row[i+6])).Elem()
@@ -137,155 +342,126 @@ func (tx *Transaction) SelectByColumn(table string, column string, value any) ([
 				log.Error("Unknown type: %v", sv.Kind())
 			}
 		}
-		results = append(results, result)
+		versions = append(versions, rowVersion{meta: base, data: result})
 	}
 
-	log.Debug("Query returned %d results", len(results))
-	return results, nil
+	return versions, rows.Err()
 }
 
 // select specified record from table, check visibility and return record data
-func (tx *Transaction) selectRecord(table string, id int, data ...any) (*RecordData, error) {
-	rows, err := appConn.QueryContext(tx.ctx, "SELECT * FROM "+table+" WHERE id = $1", id)
+func (tx *Transaction) selectRecord(table string, id int) (*RecordData, error) {
+	v, err := tx.selectVersion(table, id)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return &v.meta, nil
+}
 
-	cols, err := rows.Columns()
+// selectVersion returns the latest version of the row that was not rolled
+// back, with its data columns
+func (tx *Transaction) selectVersion(table string, id int) (*rowVersion, error) {
+	rows, err := appConn.QueryContext(tx.ctx, `
+        SELECT * FROM `+quoteIdent(table)+`
+        WHERE id = $1 AND NOT tx_min_rolled_back
+        ORDER BY tx_min DESC
+        LIMIT 1`, id)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	if !rows.Next() {
+	versions, err := scanVersions(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
 		return nil, fmt.Errorf("record not found")
 	}
 
-	values := make([]interface{}, len(cols))
-	for i := range values {
-		values[i] = new(interface{})
+	log.Debug("Selected record metadata: %+v", versions[0].meta)
+	return &versions[0], nil
+}
+
+// selectColumns returns the current values of fields in the version of the
+// row created by the transaction
+func (tx *Transaction) selectColumns(table string, id int, fields []string) (map[string]any, error) {
+	columns := make([]string, len(fields))
+	for i, field := range fields {
+		columns[i] = quoteIdent(field)
 	}
+	stmt := fmt.Sprintf(`SELECT %s FROM %s WHERE id = $1 AND tx_min = $2`, strings.Join(columns, ", "), quoteIdent(table))
 
-	err = rows.Scan(values...)
-	if err != nil {
+	values := make([]any, len(fields))
+	dest := make([]any, len(fields))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := appConn.QueryRowContext(tx.ctx, stmt, id, tx.ID).Scan(dest...); err != nil {
 		return nil, err
 	}
 
-	base := &RecordData{}
-	for i, col := range cols {
-		val := *(values[i].(*interface{}))
-		switch col {
-		case "tx_min":
-			base.TxMin = int(val.(int64))
-		case "tx_max":
-			base.TxMax = int(val.(int64))
-		case "tx_min_committed":
-			base.TxMinCommitted = val.(bool)
-		case "tx_max_committed":
-			base.TxMaxCommitted = val.(bool)
-		case "tx_min_rolled_back":
-			base.TxMinRolledBack = val.(bool)
-		case "tx_max_rolled_back":
-			base.TxMaxRolledBack = val.(bool)
-		}
+	previous := make(map[string]any, len(fields))
+	for i, field := range fields {
+		previous[field] = values[i]
 	}
-
-	log.Debug("Selected record metadata: %+v", base)
-	return base, nil
+	return previous, nil
 }
 
+// Where returns the visible rows of table whose column where equals args[0],
+// or every visible row when where is empty, in which case no args may be
+// given. The table and the column must be part of the schema.
 func (tx *Transaction) Where(table string, where string, args ...any) ([]map[string]interface{}, error) {
-	baseQuery := `
-        WITH latest_versions AS (
-            SELECT *
-            FROM ` + table
+	tx.opMu.Lock()
+	defer tx.opMu.Unlock()
 
+	ts, err := LookupTable(table)
+	if err != nil {
+		return nil, err
+	}
+	if where == "" && len(args) > 0 {
+		return nil, fmt.Errorf("%d arguments given without a where column", len(args))
+	}
+	query := `SELECT * FROM ` + ts.Ident() + ` WHERE `
 	if where != "" {
-		baseQuery += ` WHERE ` + where + ` = $2 AND `
-	} else {
-		baseQuery += ` WHERE `
+		col, err := ts.column(where)
+		if err != nil {
+			return nil, err
+		}
+		query += col + ` = $1 AND `
 	}
+	query += `NOT tx_min_rolled_back ORDER BY id, tx_min DESC`
 
-	baseQuery += `
-            tx_min_committed = true
-            AND NOT tx_min_rolled_back
-            AND (tx_max = 0 OR (tx_max > $1 AND NOT tx_max_committed))
-            ORDER BY id, tx_min DESC
-        )
-        SELECT * FROM latest_versions`
-
-	var queryArgs []interface{}
-	if len(args) > 0 {
-		queryArgs = make([]interface{}, len(args)+1)
-		queryArgs[0] = tx.ID
-		copy(queryArgs[1:], args)
-	} else {
-		queryArgs = []interface{}{tx.ID}
+	if err := tx.lockTableForRead(table); err != nil {
+		return nil, err
+	}
+	if err := tx.beginStatement(); err != nil {
+		return nil, err
 	}
 
-	rows, err := appConn.QueryContext(tx.ctx, baseQuery, queryArgs...)
+	rows, err := appConn.QueryContext(tx.ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	cols, err := rows.Columns()
+	results, err := tx.scanVisible(rows)
 	if err != nil {
 		return nil, err
 	}
 
-	var results []map[string]interface{}
-	for rows.Next() {
-		row := make([]interface{}, len(cols))
-		for i := range row {
-			row[i] = new(interface{})
-		}
-
-		err := rows.Scan(row...)
-		if err != nil {
-			return nil, err
-		}
-
-		base := RecordData{}
-		for i, col := range cols {
-			sv := reflect.Indirect(reflect.ValueOf(row[i])).Elem()
-			switch col {
-			case "tx_min":
-				base.TxMin = int(sv.Int())
-			case "tx_max":
-				base.TxMax = int(sv.Int())
-			case "tx_min_committed":
-				base.TxMinCommitted = sv.Bool()
-			case "tx_max_committed":
-				base.TxMaxCommitted = sv.Bool()
-			case "tx_min_rolled_back":
-				base.TxMinRolledBack = sv.Bool()
-			case "tx_max_rolled_back":
-				base.TxMaxRolledBack = sv.Bool()
-			}
-		}
-
-		visible := tx.IsRowVisible(&base)
-
-		if visible {
-			result := make(map[string]interface{})
-			for i, col := range cols[6:] {
-				sv := reflect.Indirect(reflect.ValueOf(row[i+6])).Elem()
-				switch sv.Kind() {
-				case reflect.Int64:
-					result[col] = sv.Int()
-				case reflect.Bool:
-					result[col] = sv.Bool()
-				case reflect.String:
-					result[col] = sv.String()
-				default:
-					log.Error("Unknown type: %v", sv.Kind())
-				}
-			}
-			results = append(results, result)
-		}
+	if err := tx.lockRowsForRead(table, results); err != nil {
+		return nil, err
+	}
+	if err := tx.checkRead(table, results); err != nil {
+		return nil, err
+	}
+	var value any
+	if len(args) > 0 {
+		value = args[0]
+	}
+	if err := tx.trackRead(table, where, value, results); err != nil {
+		return nil, err
 	}
-
 	return results, nil
 }
 
@@ -299,20 +475,43 @@ func makeQueryParams(min, max int) []string {
 
 // insert new record into table, return record id
 func (tx *Transaction) Insert(table string, fields []string, values ...any) (int, error) {
+	tx.opMu.Lock()
+	defer tx.opMu.Unlock()
+
+	ts, err := LookupTable(table)
+	if err != nil {
+		return 0, err
+	}
+	columns, err := ts.columnList(fields)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.ensureWritable(); err != nil {
+		return 0, err
+	}
+
 	if err := tx.acquireLock(table, -1, WriteLock); err != nil {
-		tx.Rollback()
-		return 0, fmt.Errorf("failed to acquire table lock: %v", err)
+		tx.rollback()
+		return 0, fmt.Errorf("failed to acquire table lock: %w", err)
 	}
 
 	time.Sleep(operationDelay)
 
 	var id int
-	seqName := table + "_id_seq"
-	err := appConn.QueryRowContext(tx.ctx, fmt.Sprintf("SELECT nextval('%s')", seqName)).Scan(&id)
+	err = appConn.QueryRowContext(tx.ctx, "SELECT nextval($1::regclass)", ts.Sequence).Scan(&id)
 	if err != nil {
 		return 0, err
 	}
 
+	if _, err := tx.checkWrite(table, id); err != nil {
+		tx.rollback()
+		return 0, err
+	}
+	if err := tx.trackWrite(table, id, fields, values); err != nil {
+		return 0, err
+	}
+
 	allFields := []string{
 		"id",
 		"tx_min",
@@ -322,9 +521,9 @@ func (tx *Transaction) Insert(table string, fields []string, values ...any) (int
 		"tx_min_rolled_back",
 		"tx_max_rolled_back",
 	}
-	allFields = append(allFields, fields...)
+	allFields = append(allFields, columns...)
 
-	stmt := "INSERT INTO " + table + " ("
+	stmt := "INSERT INTO " + ts.Ident() + " ("
 	stmt += strings.Join(allFields, ", ")
 	stmt += ") VALUES ("
 	stmt += strings.Join(makeQueryParams(1, len(allFields)+1), ", ")
@@ -345,62 +544,121 @@ func (tx *Transaction) Insert(table string, fields []string, values ...any) (int
 		return 0, fmt.Errorf("error inserting: %v", err)
 	}
 
-	tx.records = append(tx.records, Record{
+	tx.addRecord(Record{
 		Table:     table,
 		ID:        id,
 		Operation: OpInsert,
 	})
 
-	err = tx.Commit()
-	if err != nil {
-		return -1, err
-	}
-
 	return id, nil
 }
 
 func (tx *Transaction) Update(table string, id int, fields []string, values ...any) error {
-	if tx.Status != TxActive {
-		return fmt.Errorf("transaction %d is not active", tx.ID)
+	tx.opMu.Lock()
+	defer tx.opMu.Unlock()
+
+	ts, err := LookupTable(table)
+	if err != nil {
+		return err
+	}
+	columns, err := ts.columnList(fields)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.ensureWritable(); err != nil {
+		return err
 	}
 
 	time.Sleep(operationDelay)
 
 	if err := tx.acquireLock(table, -1, WriteLock); err != nil {
-		tx.Rollback()
-		return fmt.Errorf("failed to acquire lock: %v", err)
+		tx.rollback()
+		return fmt.Errorf("failed to acquire lock: %w", err)
 	}
 
 	if err := tx.acquireLock(table, id, WriteLock); err != nil {
-		tx.Rollback()
-		return fmt.Errorf("failed to acquire record lock: %v", err)
+		tx.rollback()
+		return fmt.Errorf("failed to acquire record lock: %w", err)
+	}
+
+	skip, err := tx.checkWrite(table, id)
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+	if skip {
+		return nil
 	}
 
 	time.Sleep(operationDelay)
 
-	stmt := `SELECT tx_min
-            FROM ` + table + `
-            WHERE id = $1
-            AND tx_max = 0
-            ORDER BY tx_min DESC
-            LIMIT 1`
+	if err := tx.beginStatement(); err != nil {
+		return err
+	}
 
-	var currentTxMin int
-	err := appConn.QueryRowContext(tx.ctx, stmt, id).Scan(&currentTxMin)
+	// the latest version must be visible, otherwise a concurrent transaction
+	// updated the row after the snapshot was taken
+	base, err := tx.selectRecord(table, id)
 	if err != nil {
 		return err
 	}
+	if !tx.IsRowVisible(base) {
+		return fmt.Errorf("%w: transaction %v aborted due to concurrency", ErrTxAborted, tx.ID)
+	}
+	if err := tx.trackWrite(table, id, fields, values); err != nil {
+		return err
+	}
+	currentTxMin := base.TxMin
+
+	// Version created by this transaction, overwrite it in place
+	if currentTxMin == tx.ID {
+		sets := make([]string, len(columns))
+		for i, column := range columns {
+			sets[i] = fmt.Sprintf("%s = $%d", column, i+1)
+		}
+		updateStmt := fmt.Sprintf(`UPDATE %s SET %s WHERE id = $%d AND tx_min = $%d`,
+			ts.Ident(), strings.Join(sets, ", "), len(fields)+1, len(fields)+2)
+
+		var previous map[string]any
+		if len(tx.savepoints) > 0 {
+			if previous, err = tx.selectColumns(table, id, fields); err != nil {
+				return err
+			}
+		}
+
+		args := append(append([]interface{}{}, values...), id, tx.ID)
+		if _, err := appConn.ExecContext(tx.ctx, updateStmt, args...); err != nil {
+			return err
+		}
+
+		if previous != nil {
+			tx.addRecord(Record{
+				Table:     table,
+				ID:        id,
+				Operation: OpOverwrite,
+				Previous:  previous,
+			})
+		}
+		return nil
+	}
 
 	// Mark current version as ended
-	updateStmt := `UPDATE ` + table + `
-                   SET tx_max = $1, tx_max_committed = FALSE
+	updateStmt := `UPDATE ` + ts.Ident() + `
+                   SET tx_max = $1, tx_max_committed = FALSE, tx_max_rolled_back = FALSE
                    WHERE id = $2 AND tx_min = $3 AND tx_max = 0`
-	if _, err := appConn.ExecContext(tx.ctx, updateStmt, tx.ID, id, currentTxMin); err != nil {
+	res, err := appConn.ExecContext(tx.ctx, updateStmt, tx.ID, id, currentTxMin)
+	if err != nil {
 		return err
 	}
+	// without locks, a concurrent optimistic transaction may have ended the
+	// version first
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("%w: transaction %v aborted due to concurrency", ErrTxAborted, tx.ID)
+	}
 
 	// Insert new version with same ID
-	stmt = "INSERT INTO " + table + " ("
+	stmt := "INSERT INTO " + ts.Ident() + " ("
 	f := append([]string{
 		"id",
 		"tx_min",
@@ -409,7 +667,7 @@ func (tx *Transaction) Update(table string, id int, fields []string, values ...a
 		"tx_max_committed",
 		"tx_min_rolled_back",
 		"tx_max_rolled_back",
-	}, fields...)
+	}, columns...)
 	stmt += strings.Join(f, ", ")
 	stmt += ") VALUES ("
 	params := makeQueryParams(1, len(f)+1)
@@ -431,31 +689,39 @@ func (tx *Transaction) Update(table string, id int, fields []string, values ...a
 		return err
 	}
 
-	tx.records = append(tx.records, Record{
-		Table:     table,
-		ID:        id,
-		Operation: OpUpdate,
+	tx.addRecord(Record{
+		Table:      table,
+		ID:         id,
+		Operation:  OpUpdate,
+		EndedTxMin: currentTxMin,
 	})
 
-	err = tx.Commit()
+	return nil
+}
+
+func (tx *Transaction) Delete(table string, id int) error {
+	tx.opMu.Lock()
+	defer tx.opMu.Unlock()
+
+	ts, err := LookupTable(table)
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
+	if err := tx.ensureWritable(); err != nil {
+		return err
+	}
 
-func (tx *Transaction) Delete(table string, id int) error {
 	time.Sleep(operationDelay)
 
 	if err := tx.acquireLock(table, -1, WriteLock); err != nil {
-		tx.Rollback()
-		return fmt.Errorf("failed to acquire lock: %v", err)
+		tx.rollback()
+		return fmt.Errorf("failed to acquire lock: %w", err)
 	}
 
 	var exists bool
-	err := appConn.QueryRowContext(tx.ctx,
-		"SELECT EXISTS(SELECT 1 FROM "+table+" WHERE id=$1)", id).Scan(&exists)
+	err = appConn.QueryRowContext(tx.ctx,
+		"SELECT EXISTS(SELECT 1 FROM "+ts.Ident()+" WHERE id=$1)", id).Scan(&exists)
 	if err != nil {
 		return err
 	}
@@ -464,325 +730,357 @@ func (tx *Transaction) Delete(table string, id int) error {
 	}
 
 	if err := tx.acquireLock(table, id, WriteLock); err != nil {
-		tx.Rollback()
-		return fmt.Errorf("failed to acquire lock: %v", err)
+		tx.rollback()
+		return fmt.Errorf("failed to acquire lock: %w", err)
+	}
+
+	skip, err := tx.checkWrite(table, id)
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+	if skip {
+		return nil
 	}
 
 	time.Sleep(operationDelay)
 
-	base, err := tx.selectRecord(table, id)
+	if err := tx.beginStatement(); err != nil {
+		return err
+	}
+
+	latest, err := tx.selectVersion(table, id)
 	if err != nil {
 		return fmt.Errorf("failed to select record: %v", err)
 	}
+	base := &latest.meta
 
-	if !tx.IsRowVisible(base) {
-		return fmt.Errorf("transaction %v aborted due to concurrency", tx.ID)
+	// the latest version must be visible and not already ended by another
+	// transaction, committed or not
+	if !tx.IsRowVisible(base) || base.TxMax != 0 {
+		tx.rollback()
+		return fmt.Errorf("%w: transaction %v aborted due to concurrency", ErrTxAborted, tx.ID)
 	}
-
-	updateStmt := `UPDATE ` + table + ` 
-                   SET tx_max = $1, tx_max_rolled_back = FALSE
-                   WHERE tx_min = $2 AND id = $3`
-	if _, err := appConn.ExecContext(tx.ctx, updateStmt, tx.ID, base.TxMin, id); err != nil {
+	// the deleted values leave every predicate they matched
+	fields := make([]string, 0, len(latest.data))
+	values := make([]any, 0, len(latest.data))
+	for field, value := range latest.data {
+		fields = append(fields, field)
+		values = append(values, value)
+	}
+	if err := tx.trackWrite(table, id, fields, values); err != nil {
 		return err
 	}
 
-	tx.records = append(tx.records, Record{
-		Table:     table,
-		ID:        id,
-		Operation: OpDelete,
-	})
-
-	err = tx.Commit()
+	updateStmt := `UPDATE ` + ts.Ident() + `
+                   SET tx_max = $1, tx_max_committed = FALSE, tx_max_rolled_back = FALSE
+                   WHERE tx_min = $2 AND id = $3 AND tx_max = 0`
+	res, err := appConn.ExecContext(tx.ctx, updateStmt, tx.ID, base.TxMin, id)
 	if err != nil {
 		return err
 	}
+	// without locks, a concurrent optimistic transaction may have ended the
+	// version first
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		tx.rollback()
+		return fmt.Errorf("%w: transaction %v aborted due to concurrency", ErrTxAborted, tx.ID)
+	}
+
+	tx.addRecord(Record{
+		Table:      table,
+		ID:         id,
+		Operation:  OpDelete,
+		EndedTxMin: base.TxMin,
+	})
 
 	return nil
 }
 
-func (tx *Transaction) Commit() error {
-	defer func() {
-		log.Debug("Deleting locks for transaction %d", tx.ID)
-		_, err := mvccConn.ExecContext(tx.ctx,
-			"DELETE FROM locks WHERE txid = $1",
-			tx.ID)
-		if err != nil {
-			log.Error("Failed to delete locks: %v", err)
+func (tx *Transaction) addRecord(r Record) {
+	tx.records = append(tx.records, r)
+	tx.written.Add(1)
+}
+
+func (tx *Transaction) ensureActive() error {
+	if tx.Status != TxActive {
+		if err := tx.AbortReason(); err != nil {
+			return fmt.Errorf("transaction %d is not active: %w", tx.ID, err)
 		}
-	}()
-	log.Info("Starting commit for transaction %d", tx.ID)
+		return fmt.Errorf("transaction %d is not active", tx.ID)
+	}
+	return nil
+}
 
-	if err := tx.checkDependencyCycle(); err != nil {
+// Commit makes every version written by the transaction visible at once. The
+// committed flags in the app database and the transaction status in the mvcc
+// database are changed through a two-phase commit, so either both databases
+// reflect the commit or neither does.
+func (tx *Transaction) Commit() error {
+	tx.opMu.Lock()
+	defer tx.opMu.Unlock()
+
+	if err := tx.ensureActive(); err != nil {
 		return err
 	}
+	if tx.readOnly {
+		tx.finishReadOnly(TxCommitted)
+		return nil
+	}
 
-	t, err := mvccConn.BeginTx(tx.ctx, nil)
-	if err != nil {
+	log.Info("Starting commit for transaction %d", tx.ID)
+
+	if err := ssi.commit(tx.ID); err != nil {
+		tx.rollback()
+		return err
+	}
+	if err := occ.beginCommit(tx.ID); err != nil {
+		tx.rollback()
 		return err
 	}
 
-	for _, r := range tx.records {
-		switch r.Operation {
-		case OpDelete:
-			stmt := `UPDATE ` + r.Table + `
-                     SET tx_max_committed = TRUE
-                     WHERE id = $1 AND tx_max = $2`
-			_, err := appConn.ExecContext(tx.ctx, stmt, r.ID, tx.ID)
-			if err != nil {
-				t.Rollback()
-				return err
-			}
-		case OpInsert, OpUpdate:
-			stmt := `UPDATE ` + r.Table + `
-                     SET tx_min_committed = TRUE
-                     WHERE id = $1 AND tx_min = $2`
-			_, err := appConn.ExecContext(tx.ctx, stmt, r.ID, tx.ID)
-			if err != nil {
-				t.Rollback()
+	// nothing was written to the app database, the status alone commits
+	if len(tx.records) == 0 {
+		if err := tx.commitStatus(); err != nil {
+			occ.endCommit(tx.ID, false)
+			tx.rollback()
+			return err
+		}
+		tx.Status = TxCommitted
+		occ.endCommit(tx.ID, true)
+		tx.end()
+		return nil
+	}
+
+	c := newCoordinator(tx.ID)
+	err := c.prepare(tx.ctx, func(app, mvcc execer) error {
+		for _, r := range tx.records {
+			if err := commitRecord(tx.ctx, app, r, tx.ID); err != nil {
 				return err
 			}
 		}
-	}
 
-	_, err = mvccConn.ExecContext(tx.ctx,
-		"DELETE FROM locks WHERE txid = $1",
-		tx.ID)
+		stmt := `UPDATE transactions SET status = $1 WHERE id = $2;`
+		if _, err := mvcc.ExecContext(tx.ctx, stmt, TxCommitted, tx.ID); err != nil {
+			return err
+		}
+		if err := tx.commitWriteTimestamps(mvcc); err != nil {
+			return err
+		}
+
+		_, err := mvcc.ExecContext(tx.ctx, "DELETE FROM locks WHERE txid = $1", tx.ID)
+		return err
+	})
+	if err == nil {
+		err = c.decide(tx.ctx)
+	}
 	if err != nil {
-		t.Rollback()
+		c.finish(context.WithoutCancel(tx.ctx), DecisionAbort)
+		occ.endCommit(tx.ID, false)
+		tx.rollback()
 		return err
 	}
 
-	stmt := `UPDATE transactions SET status = $1 WHERE id = $2;`
-	_, err = mvccConn.ExecContext(tx.ctx, stmt, TxCommitted, tx.ID)
+	tx.Status = TxCommitted
+
+	// the decision is logged, so the transaction is committed even if phase
+	// two fails here; it is then completed by ResolvePrepared on restart
+	if err := c.finish(context.WithoutCancel(tx.ctx), DecisionCommit); err != nil {
+		log.Error("Failed to complete commit of transaction %d: %v", tx.ID, err)
+	}
+	occ.endCommit(tx.ID, true)
+	tx.end()
+
+	return nil
+}
+
+// commitStatus commits a transaction that wrote no version in the mvcc
+// database alone, without a two-phase commit
+func (tx *Transaction) commitStatus() error {
+	t, err := mvccConn.BeginTx(tx.ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer t.Rollback()
 
-	tx.Status = TxCommitted
+	stmt := `UPDATE transactions SET status = $1 WHERE id = $2;`
+	if _, err := t.ExecContext(tx.ctx, stmt, TxCommitted, tx.ID); err != nil {
+		return err
+	}
+	if err := tx.commitWriteTimestamps(t); err != nil {
+		return err
+	}
+	if _, err := t.ExecContext(tx.ctx, "DELETE FROM locks WHERE txid = $1", tx.ID); err != nil {
+		return err
+	}
 	return t.Commit()
 }
 
+// Rollback undoes every recorded operation in reverse order: created versions
+// are marked as rolled back and versions ended by the transaction become live
+// again.
 func (tx *Transaction) Rollback() error {
 	if tx == nil {
 		return errors.New("attempt to rollback nil transaction")
 	}
-	if tx.Status == TxCommitted {
+	tx.opMu.Lock()
+	defer tx.opMu.Unlock()
+
+	return tx.rollback()
+}
+
+// rollback runs even when tx.ctx is cancelled, so that an aborted transaction
+// always releases what it holds
+func (tx *Transaction) rollback() error {
+	if tx.Status != TxActive {
 		return nil
 	}
+	if tx.readOnly {
+		tx.finishReadOnly(TxRolledBack)
+		return nil
+	}
+	defer tx.releaseLocks()
 
 	log.Debug("Rolling back transaction %d", tx.ID)
 
-	t, err := mvccConn.BeginTx(tx.ctx, nil)
+	ctx := context.WithoutCancel(tx.ctx)
+	t, err := appConn.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 
-	for _, r := range tx.records {
-		switch r.Operation {
-		case OpDelete:
-			stmt := `UPDATE ` + r.Table + ` SET tx_max_rolled_back = TRUE WHERE tx_max = $1 AND id = $2;`
-			_, err := appConn.ExecContext(tx.ctx, stmt, tx.ID, r.ID)
-			if err != nil {
-				return err
-			}
+	for i := len(tx.records) - 1; i >= 0; i-- {
+		if err := rollbackRecord(ctx, t, tx.records[i], tx.ID); err != nil {
+			t.Rollback()
+			return err
+		}
+	}
 
-			stmt = `DELETE FROM locks WHERE id = $1;`
-			_, err = mvccConn.ExecContext(tx.ctx, stmt, r.LockID)
-			if err != nil {
-				return err
-			}
-		case OpInsert:
-			stmt := `UPDATE ` + r.Table + ` SET tx_min_rolled_back = TRUE WHERE tx_min = $1 AND id = $2;`
-			_, err := appConn.ExecContext(tx.ctx, stmt, tx.ID, r.ID)
-			if err != nil {
-				return err
-			}
+	if err := t.Commit(); err != nil {
+		return err
+	}
+
+	if tx.scheduler.OrdersTimestamps() {
+		if err := restoreWriteTimestamps(ctx, mvccConn, tx.ID); err != nil {
+			return err
 		}
 	}
 
 	stmt := `UPDATE transactions SET status = $1 WHERE id = $2;`
-	_, err = mvccConn.ExecContext(tx.ctx, stmt, TxRolledBack, tx.ID)
+	_, err = mvccConn.ExecContext(ctx, stmt, TxRolledBack, tx.ID)
 	if err != nil {
 		return err
 	}
 
 	tx.Status = TxRolledBack
-	return t.Commit()
+	return nil
 }
 
-func Vacuum(ctx context.Context) (int, error) {
-	// Get active transactions
-	rows, err := mvccConn.QueryContext(ctx, `
-        SELECT id, created_at, status 
-        FROM transactions 
-        WHERE status = 'active'`)
+func (tx *Transaction) releaseLocks() {
+	log.Debug("Deleting locks for transaction %d", tx.ID)
+	_, err := mvccConn.ExecContext(context.WithoutCancel(tx.ctx),
+		"DELETE FROM locks WHERE txid = $1",
+		tx.ID)
 	if err != nil {
-		return 0, err
-	}
-	defer rows.Close()
-
-	var activeTxs []TransactionData
-	for rows.Next() {
-		var tx TransactionData
-		if err := rows.Scan(&tx.ID, &tx.CreatedAt, &tx.Status); err != nil {
-			return 0, err
-		}
-		activeTxs = append(activeTxs, tx)
-	}
-
-	tables := []string{"users", "accounts", "audit"}
-	delCount := 0
-
-	for _, table := range tables {
-		rows, err = appConn.QueryContext(ctx, `
-        WITH duplicates AS (
-            SELECT id, 
-                   tx_min,
-                   tx_max,
-                   row_number() OVER (
-                       PARTITION BY id 
-                       ORDER BY tx_max DESC
-                   ) as rn
-            FROM `+table+`
-            WHERE tx_max_committed = true
-        )
-        SELECT d.id, d.tx_min, d.tx_max
-        FROM duplicates d
-        WHERE d.rn > 1`)
-
-		if err != nil {
-			return 0, err
-		}
-
-		toDelete := make([]int, 0)
-		rowCount := 0
-
-		for rows.Next() {
-			rowCount++
-			var txMin, txMax, id int
-			if err := rows.Scan(&id, &txMin, &txMax); err != nil {
-				return 0, err
-			}
-
-			canBeDeleted := true
-			for _, tx := range activeTxs {
-				if tx.ID > txMin && tx.ID < txMax {
-					canBeDeleted = false
-					break
-				}
-			}
-
-			if canBeDeleted {
-				toDelete = append(toDelete, id)
-			}
-		}
-
-		log.Info("Found %d rows marked for deletion in table %s", rowCount, table)
-
-		if len(toDelete) > 0 {
-			query := fmt.Sprintf("DELETE FROM %s WHERE id = ANY($1)", table)
-			result, err := appConn.ExecContext(ctx, query, pq.Array(toDelete))
-			if err != nil {
-				return 0, err
-			}
-			count, _ := result.RowsAffected()
-			delCount += int(count)
-		}
+		log.Error("Failed to delete locks: %v", err)
 	}
-
-	return delCount, nil
+	tx.end()
 }
 
-func (tx *Transaction) AcquireLock(table string, id int, lockType LockType) error {
-	return tx.acquireLock(table, id, lockType)
+// end removes every trace of a finished transaction from the lock manager
+func (tx *Transaction) end() {
+	if err := tx.cleanupDependencies(); err != nil {
+		log.Error("Failed to clean up dependencies: %v", err)
+	}
+	tx.wakeWaiters()
+	liveTxs.remove(tx.ID)
+	tx.stopWatch()
+	ssi.finish(tx.ID, tx.Status == TxCommitted)
+	occ.finish(tx.ID)
+	tx.cancel()
 }
 
-func getTables(conn *sql.DB) ([]string, error) {
-	rows, err := conn.Query(`
-    SELECT tablename
-    FROM pg_catalog.pg_tables
-    WHERE schemaname != 'pg_catalog'
-    AND schemaname != 'information_schema'
-    AND tablename != 'schema_migrations';`)
-	if err != nil {
-		return nil, fmt.Errorf("failed to query tables: %v", err)
+// forgets the locks held by the transaction and wakes their waiters
+func (tx *Transaction) wakeWaiters() {
+	keys := make([]lockKey, 0, len(tx.heldLocks))
+	for key := range tx.heldLocks {
+		keys = append(keys, key)
 	}
-	defer rows.Close()
+	tx.heldLocks = make(map[lockKey]LockType)
+	tx.grants = nil
+	lockQueue.wake(keys...)
+}
 
-	tables := make([]string, 0)
-	for rows.Next() {
-		var tableName string
-		if err := rows.Scan(&tableName); err != nil {
-			return nil, fmt.Errorf("failed to scan table name: %v", err)
+// marks the versions created or ended by a recorded operation as committed
+func commitRecord(ctx context.Context, t execer, r Record, txID int) error {
+	if r.Operation == OpInsert || r.Operation == OpUpdate {
+		stmt := `UPDATE ` + quoteIdent(r.Table) + `
+                 SET tx_min_committed = TRUE
+                 WHERE id = $1 AND tx_min = $2`
+		if _, err := t.ExecContext(ctx, stmt, r.ID, txID); err != nil {
+			return err
 		}
-		tables = append(tables, tableName)
 	}
-
-	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating tables: %v", err)
+	if r.Operation == OpUpdate || r.Operation == OpDelete {
+		stmt := `UPDATE ` + quoteIdent(r.Table) + `
+                 SET tx_max_committed = TRUE
+                 WHERE id = $1 AND tx_max = $2 AND tx_min = $3`
+		if _, err := t.ExecContext(ctx, stmt, r.ID, txID, r.EndedTxMin); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	if len(tables) == 0 {
-		log.Debug("No tables found in database")
-	} else {
-		log.Debug("Found tables: %v", tables)
-	}
-
-	return tables, nil
-}
-
-func (tx *Transaction) checkDependencyCycle() error {
-	// log.Debug("Starting dependency cycle check for transaction %d", tx.ID)
-	rows, err := mvccConn.QueryContext(tx.ctx, `
-        WITH RECURSIVE dependency_chain AS (
-            SELECT path, 1 as depth
-            FROM paths
-            WHERE path <@ text2ltree('root.dependencies.tx_' || $1::text)
-            AND dependency_type = 'target'
-
-            UNION ALL
-
-            SELECT p.path, dc.depth + 1
-            FROM paths p
-            JOIN dependency_chain dc ON p.path <@ dc.path
-            WHERE p.dependency_type = 'target'
-            AND p.path != dc.path
-        )
-        SELECT EXISTS (
-            SELECT 1 FROM dependency_chain
-            WHERE depth > (
-                SELECT COUNT(DISTINCT id)
-                FROM transactions
-                WHERE status = 'active'
-            )
-        ) as has_cycle;`,
-		tx.ID,
-	)
-	if err != nil {
+// undoes a recorded operation: created versions are rolled back and ended
+// versions are restored
+func rollbackRecord(ctx context.Context, t execer, r Record, txID int) error {
+	if r.Operation == OpOverwrite {
+		fields := make([]string, 0, len(r.Previous))
+		args := make([]any, 0, len(r.Previous)+2)
+		for field, value := range r.Previous {
+			args = append(args, value)
+			fields = append(fields, fmt.Sprintf("%s = $%d", quoteIdent(field), len(args)))
+		}
+		stmt := fmt.Sprintf(`UPDATE %s SET %s WHERE id = $%d AND tx_min = $%d`,
+			quoteIdent(r.Table), strings.Join(fields, ", "), len(args)+1, len(args)+2)
+		_, err := t.ExecContext(ctx, stmt, append(args, r.ID, txID)...)
 		return err
 	}
-	defer rows.Close()
-
-	var hasCycle bool
-	if rows.Next() {
-		err = rows.Scan(&hasCycle)
-		if err != nil {
+	if r.Operation == OpInsert || r.Operation == OpUpdate {
+		stmt := `UPDATE ` + quoteIdent(r.Table) + ` SET tx_min_rolled_back = TRUE WHERE tx_min = $1 AND id = $2;`
+		if _, err := t.ExecContext(ctx, stmt, txID, r.ID); err != nil {
 			return err
 		}
 	}
-
-	if hasCycle {
-		return errors.New("dependency cycle detected")
+	if r.Operation == OpUpdate || r.Operation == OpDelete {
+		stmt := `UPDATE ` + quoteIdent(r.Table) + `
+                 SET tx_max = 0, tx_max_committed = FALSE, tx_max_rolled_back = TRUE
+                 WHERE tx_max = $1 AND id = $2 AND tx_min = $3;`
+		if _, err := t.ExecContext(ctx, stmt, txID, r.ID, r.EndedTxMin); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+func (tx *Transaction) AcquireLock(table string, id int, lockType LockType) error {
+	tx.opMu.Lock()
+	defer tx.opMu.Unlock()
+
+	if _, err := LookupTable(table); err != nil {
+		return err
+	}
+
+	return tx.acquireLock(table, id, lockType)
+}
+
 func (tx *Transaction) cleanupDependencies() error {
 	log.Debug("Cleaning up dependencies for transaction %d", tx.ID)
-	_, err := mvccConn.ExecContext(tx.ctx, `
+	_, err := mvccConn.ExecContext(context.WithoutCancel(tx.ctx), `
         DELETE FROM paths
         WHERE path <@ text2ltree('root.dependencies.tx_' || $1::text)
-        OR path <@ text2ltree('root.locks.tx_' || $1::text)`,
+        OR path <@ text2ltree('root.locks.tx_' || $1::text)
+        OR path ~ ('root.dependencies.*{1}.tx_' || $1::text)::lquery`,
 		strconv.Itoa(tx.ID),
 	)
 	return err
@@ -0,0 +1,79 @@
+package models
+
+import (
+	"context"
+	"sync"
+)
+
+// number of transaction IDs reserved from the sequence per round trip
+const txIDBatchSize = 32
+
+// txIDAllocator hands out transaction IDs reserved in batches from the
+// transactions sequence. IDs are handed out in increasing order, but
+// transactions may insert their rows out of order, so an ID stays opening
+// until its row is written. Snapshots count opening IDs as in progress.
+// Like the lock wait queues, this assumes a single server process.
+type txIDAllocator struct {
+	mu       sync.Mutex
+	reserved []int
+	opening  map[int]bool
+}
+
+var txIDs = &txIDAllocator{opening: make(map[int]bool)}
+
+// next returns an unused ID and marks it opening. Callers only block each
+// other while a new batch is reserved.
+func (a *txIDAllocator) next(ctx context.Context) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.reserved) == 0 {
+		if err := a.reserve(ctx); err != nil {
+			return 0, err
+		}
+	}
+
+	id := a.reserved[0]
+	a.reserved = a.reserved[1:]
+	a.opening[id] = true
+	return id, nil
+}
+
+func (a *txIDAllocator) reserve(ctx context.Context) error {
+	rows, err := mvccConn.QueryContext(ctx,
+		`SELECT nextval('transactions_id_seq') FROM generate_series(1, $1) ORDER BY 1`,
+		txIDBatchSize)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		a.reserved = append(a.reserved, id)
+	}
+	return rows.Err()
+}
+
+// opened marks the row of id as written, or the ID as abandoned
+func (a *txIDAllocator) opened(id int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.opening, id)
+}
+
+// openingIDs must be read before the transactions table when taking a
+// snapshot: an ID that is no longer opening then has its row visible
+func (a *txIDAllocator) openingIDs() []int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ids := make([]int, 0, len(a.opening))
+	for id := range a.opening {
+		ids = append(ids, id)
+	}
+	return ids
+}
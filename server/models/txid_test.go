@@ -0,0 +1,45 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// BenchmarkOpenTx opens and rolls back empty transactions from 1, 8 and 64
+// goroutines. RunParallel starts a multiple of GOMAXPROCS goroutines, so the
+// larger counts are rounded up to one.
+func BenchmarkOpenTx(b *testing.B) {
+	openTestDB(b)
+
+	for _, goroutines := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("goroutines=%d", goroutines), func(b *testing.B) {
+			if goroutines == 1 {
+				for i := 0; i < b.N; i++ {
+					openAndRollback(b)
+				}
+				return
+			}
+
+			procs := runtime.GOMAXPROCS(0)
+			b.SetParallelism((goroutines + procs - 1) / procs)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					openAndRollback(b)
+				}
+			})
+		})
+	}
+}
+
+func openAndRollback(b *testing.B) {
+	tx, err := OpenTx(context.Background())
+	if err != nil {
+		b.Error(err)
+		return
+	}
+	if err := tx.Rollback(); err != nil {
+		b.Error(err)
+	}
+}
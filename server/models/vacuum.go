@@ -0,0 +1,165 @@
+package models
+
+import (
+	"context"
+	"dt/utils/log"
+	"fmt"
+	"time"
+)
+
+// VacuumRun describes one vacuum pass over a table
+type VacuumRun struct {
+	Table     string        `json:"table"`
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+	// dead versions examined, and those of them deleted
+	Scanned int `json:"scanned"`
+	Deleted int `json:"deleted"`
+	// versions ended by transactions from the horizon on were kept
+	Horizon int `json:"horizon"`
+}
+
+// TableStats counts the versions of a table. Dead versions are those vacuum
+// would delete: created by a rolled back transaction, or ended by a committed
+// one below the vacuum horizon.
+type TableStats struct {
+	Table    string `json:"table"`
+	Versions int    `json:"versions"`
+	Dead     int    `json:"dead"`
+}
+
+// VersionStats counts the versions of every versioned table
+func VersionStats(ctx context.Context) ([]TableStats, error) {
+	horizon, err := vacuumHorizon(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := VersionedTables()
+	stats := make([]TableStats, 0, len(tables))
+	for _, table := range tables {
+		s := TableStats{Table: table}
+		err := appConn.QueryRowContext(ctx, `
+            SELECT COUNT(*),
+                   COUNT(*) FILTER (WHERE tx_min_rolled_back
+                       OR (tx_max <> 0 AND tx_max_committed AND NOT tx_max_rolled_back AND tx_max < $1))
+            FROM `+quoteIdent(table), horizon).Scan(&s.Versions, &s.Dead)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// oldestSnapshot returns the lowest XMin among the snapshots of running
+// transactions, including transactions still opening and active ones owned
+// by no transaction in this process. Every transaction below it has
+// finished for all of them, and for any snapshot taken later.
+func oldestSnapshot(ctx context.Context) (int, error) {
+	var oldest int
+	err := mvccConn.QueryRowContext(ctx, `
+        SELECT LEAST(
+            COALESCE((SELECT MIN(id) FROM transactions WHERE status = $1), 2147483647),
+            COALESCE((SELECT MAX(id) FROM transactions), 0) + 1)`,
+		TxActive).Scan(&oldest)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range txIDs.openingIDs() {
+		oldest = min(oldest, id)
+	}
+	for _, tx := range liveTxs.all() {
+		if xmin := int(tx.xmin.Load()); xmin != 0 {
+			oldest = min(oldest, xmin)
+		}
+	}
+	if xmin := readOnlySnapshots.oldest(); xmin != 0 {
+		oldest = min(oldest, xmin)
+	}
+	return oldest, nil
+}
+
+// Vacuum removes the versions no snapshot can see anymore from every
+// versioned table and returns how many were deleted
+func Vacuum(ctx context.Context) (int, error) {
+	runs, err := VacuumTables(ctx, VersionedTables())
+	deleted := 0
+	for _, run := range runs {
+		deleted += run.Deleted
+	}
+	return deleted, err
+}
+
+// vacuumHorizon returns the transaction from which ended versions are kept:
+// the oldest snapshot, or the start of the history retention window when it
+// is older
+func vacuumHorizon(ctx context.Context) (int, error) {
+	horizon, err := oldestSnapshot(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if retainFrom, err := retentionHorizon(ctx); err != nil {
+		return 0, err
+	} else if retainFrom != 0 {
+		horizon = min(horizon, retainFrom)
+	}
+	return horizon, nil
+}
+
+// VacuumTables vacuums the given tables. Versions ended by a transaction at
+// or after the oldest snapshot, or within the history retention window, are
+// kept.
+func VacuumTables(ctx context.Context, tables []string) ([]VacuumRun, error) {
+	horizon, err := vacuumHorizon(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]VacuumRun, 0, len(tables))
+	for _, table := range tables {
+		run, err := vacuumTable(ctx, table, horizon)
+		if err != nil {
+			return runs, fmt.Errorf("failed to vacuum %s: %w", table, err)
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// vacuumTable deletes the versions of table that are dead for every
+// snapshot: versions created by a rolled back transaction, and versions ended
+// by a committed transaction below the horizon. Rows are never deleted as a
+// whole, so the current version of a row always stays.
+func vacuumTable(ctx context.Context, table string, horizon int) (VacuumRun, error) {
+	run := VacuumRun{Table: table, StartedAt: time.Now(), Horizon: horizon}
+	ts, err := LookupTable(table)
+	if err != nil {
+		return run, err
+	}
+
+	err = appConn.QueryRowContext(ctx, `
+        WITH dead AS (
+            SELECT id, tx_min, tx_max, tx_min_rolled_back
+            FROM `+ts.Ident()+`
+            WHERE tx_min_rolled_back
+               OR (tx_max <> 0 AND tx_max_committed AND NOT tx_max_rolled_back)
+        ), deleted AS (
+            DELETE FROM `+ts.Ident()+` t
+            USING dead d
+            WHERE t.id = d.id AND t.tx_min = d.tx_min
+              AND (d.tx_min_rolled_back OR d.tx_max < $1)
+            RETURNING 1
+        )
+        SELECT (SELECT COUNT(*) FROM dead), (SELECT COUNT(*) FROM deleted)`,
+		horizon).Scan(&run.Scanned, &run.Deleted)
+	if err != nil {
+		return run, err
+	}
+
+	log.Info("Vacuumed %d of %d dead versions in table %s", run.Deleted, run.Scanned, table)
+
+	run.Duration = time.Since(run.StartedAt)
+	return run, nil
+}
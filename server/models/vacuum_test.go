@@ -0,0 +1,121 @@
+package models
+
+import (
+	"context"
+	"maps"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestVacuumKeepsVisibleVersions checks that vacuum never changes what an
+// open transaction sees. Each round opens a reader at a random isolation
+// level, runs a random write left open, vacuums and compares the views of
+// every open transaction, the writer included, before and after. The writer
+// then commits or rolls back, and the oldest reader sometimes closes so the
+// horizon moves.
+func TestVacuumKeepsVisibleVersions(t *testing.T) {
+	openTestDB(t)
+
+	seed := time.Now().UnixNano()
+	t.Logf("seed %d", seed)
+	rng := rand.New(rand.NewSource(seed))
+
+	userID, ids := createAccounts(t, 100, 100, 100)
+	live := slices.Clone(ids)
+
+	var readers []*Transaction
+	for round := 0; round < 10; round++ {
+		readers = append(readers, openReader(t, rng))
+
+		writer := mustOpenTx(t)
+		committedLive := slices.Clone(live)
+		randomWrite(t, rng, writer, userID, &live)
+
+		open := append(slices.Clone(readers), writer)
+		before := make([]map[int64]int64, len(open))
+		for i, tx := range open {
+			before[i] = accountView(t, tx, userID)
+		}
+
+		if _, err := Vacuum(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		for i, tx := range open {
+			if after := accountView(t, tx, userID); !maps.Equal(before[i], after) {
+				t.Fatalf("round %d: vacuum changed the view of %s transaction %d from %v to %v",
+					round, tx.isolation, tx.ID, before[i], after)
+			}
+		}
+
+		if rng.Intn(4) == 0 {
+			writer.Rollback()
+			live = committedLive
+		} else if err := writer.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if rng.Intn(2) == 0 {
+			readers[0].Commit()
+			readers = readers[1:]
+		}
+	}
+}
+
+func openReader(tb testing.TB, rng *rand.Rand) *Transaction {
+	tb.Helper()
+
+	switch rng.Intn(3) {
+	case 0:
+		return mustOpenTx(tb, WithIsolation(ReadCommitted))
+	case 1:
+		return mustOpenTx(tb, WithIsolation(RepeatableRead))
+	default:
+		tx, err := OpenReadOnlyTx(context.Background())
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(func() { tx.Rollback() })
+		return tx
+	}
+}
+
+// randomWrite inserts, updates or deletes an account of the user, keeping
+// live in step as if tx commits
+func randomWrite(tb testing.TB, rng *rand.Rand, tx *Transaction, userID int, live *[]int) {
+	tb.Helper()
+
+	var err error
+	switch op := rng.Intn(3); {
+	case op == 0 || len(*live) == 0:
+		var id int
+		id, err = tx.Insert("accounts", []string{"user_id", "balance"}, userID, rng.Intn(1000))
+		*live = append(*live, id)
+	case op == 1:
+		id := (*live)[rng.Intn(len(*live))]
+		err = tx.Update("accounts", id, []string{"balance"}, rng.Intn(1000))
+	default:
+		i := rng.Intn(len(*live))
+		err = tx.Delete("accounts", (*live)[i])
+		*live = slices.Delete(*live, i, i+1)
+	}
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// accountView maps the accounts of the user visible to tx to their balance
+func accountView(tb testing.TB, tx *Transaction, userID int) map[int64]int64 {
+	tb.Helper()
+
+	rows, err := tx.Where("accounts", "user_id", userID)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	view := make(map[int64]int64, len(rows))
+	for _, row := range rows {
+		view[row["id"].(int64)] = row["balance"].(int64)
+	}
+	return view
+}
@@ -2,6 +2,7 @@ package services
 
 import (
 	"context"
+	"dt/models"
 	"dt/utils/log"
 	"fmt"
 	"time"
@@ -20,6 +21,18 @@ type AccountService struct {
 type TransferResult struct {
 	FromAccount *Account `json:"from_account"`
 	ToAccount   *Account `json:"to_account"`
+	Attempts    int      `json:"attempts"`
+}
+
+// AccountVersion is a committed version of an account with the transactions
+// that created and ended it. Start times are null for transactions whose
+// metadata was garbage collected.
+type AccountVersion struct {
+	Account
+	CreatedBy int        `json:"created_by"`
+	CreatedAt *time.Time `json:"created_at"`
+	EndedBy   int        `json:"ended_by,omitempty"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
 }
 
 func NewAccountService(mvccService *MVCCService) *AccountService {
@@ -28,7 +41,7 @@ func NewAccountService(mvccService *MVCCService) *AccountService {
 
 func (as *AccountService) ListAccounts(ctx context.Context, userID int) (*[]Account, error) {
 	log.Info("Service: ListAccounts called with userID=%d", userID)
-	tx, err := as.mvccService.OpenTx(ctx)
+	tx, err := as.mvccService.OpenReadOnlyTx(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -67,21 +80,55 @@ func (as *AccountService) ListAccounts(ctx context.Context, userID int) (*[]Acco
 	return &accounts, nil
 }
 
-func (as *AccountService) CreateAccount(ctx context.Context, userID int) (*Account, error) {
-	log.Info("Service: CreateAccount called with userID=%d", userID)
-	tx, err := as.mvccService.OpenTx(ctx)
+// History returns every committed version of the account, oldest first
+func (as *AccountService) History(ctx context.Context, accountID int) ([]AccountVersion, error) {
+	tx, err := as.mvccService.OpenReadOnlyTx(ctx)
 	if err != nil {
-		tx.Rollback()
 		return nil, err
 	}
+	defer tx.Rollback()
 
-	id, err := tx.Insert("accounts", []string{"user_id", "balance"}, userID, 0)
+	versions, err := tx.History("accounts", accountID)
 	if err != nil {
-		tx.Rollback()
 		return nil, err
 	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("account not found")
+	}
+
+	history := make([]AccountVersion, 0, len(versions))
+	for _, v := range versions {
+		history = append(history, AccountVersion{
+			Account: Account{
+				ID:      accountID,
+				UserID:  int(v.Data["user_id"].(int64)),
+				Balance: int(v.Data["balance"].(int64)),
+			},
+			CreatedBy: v.CreatedBy,
+			CreatedAt: v.CreatedAt,
+			EndedBy:   v.EndedBy,
+			EndedAt:   v.EndedAt,
+		})
+	}
 
-	err = tx.Commit()
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// CreateAccount opens an empty account for the user. Aborted attempts are
+// restarted by RunTx.
+func (as *AccountService) CreateAccount(ctx context.Context, userID int) (*Account, error) {
+	log.Info("Service: CreateAccount called with userID=%d", userID)
+
+	var id int
+	_, err := as.mvccService.RunTx(ctx, func(tx *models.Transaction) error {
+		var err error
+		id, err = tx.Insert("accounts", []string{"user_id", "balance"}, userID, 0)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -93,123 +140,109 @@ func (as *AccountService) CreateAccount(ctx context.Context, userID int) (*Accou
 	}, nil
 }
 
+// Deposit adds amount to the balance of the account and records an audit
+// entry. Aborted attempts are restarted by RunTx.
 func (as *AccountService) Deposit(ctx context.Context, accountID, amount int) (*Account, error) {
-	tx, err := as.mvccService.OpenTx(ctx)
-	if err != nil {
-		return nil, err
-	}
-	defer tx.Rollback()
+	var acc Account
+	_, err := as.mvccService.RunTx(ctx, func(tx *models.Transaction) error {
+		// Get latest account data
+		accounts, err := tx.Where("accounts", "id", accountID)
+		if err != nil {
+			return err
+		}
+		if len(accounts) == 0 {
+			return fmt.Errorf("account not found")
+		}
 
-	// Get latest account data
-	accounts, err := tx.Where("accounts", "id", accountID)
-	if err != nil || len(accounts) == 0 {
-		return nil, fmt.Errorf("account not found")
-	}
+		acc = Account{
+			ID:      accountID,
+			UserID:  int(accounts[0]["user_id"].(int64)),
+			Balance: int(accounts[0]["balance"].(int64)),
+		}
 
-	var acc Account
-	acc.ID = accountID
-	acc.UserID = int(accounts[0]["user_id"].(int64))
-	acc.Balance = int(accounts[0]["balance"].(int64))
-	newBalance := acc.Balance + amount
-
-	// Update with all required fields
-	err = tx.Update("accounts", accountID,
-		[]string{"balance", "user_id"},
-		newBalance, acc.UserID)
-	if err != nil {
-		return nil, err
-	}
+		// Update with all required fields
+		err = tx.Update("accounts", accountID,
+			[]string{"balance", "user_id"},
+			acc.Balance+amount, acc.UserID)
+		if err != nil {
+			return err
+		}
 
-	// Create audit entry
-	_, err = tx.Insert("audit", []string{"timestamp", "operation", "user_id"},
-		time.Now(), "deposit", acc.UserID)
+		// Create audit entry
+		_, err = tx.Insert("audit", []string{"timestamp", "operation", "user_id"},
+			time.Now(), "deposit", acc.UserID)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	if err = tx.Commit(); err != nil {
-		return nil, err
-	}
-
-	acc.Balance = newBalance
+	acc.Balance += amount
 	return &acc, nil
 }
 
+// Transfer moves amount between two accounts and records an audit entry, all in
+// a single transaction. Aborted attempts are restarted by RunTx.
 func (as *AccountService) Transfer(ctx context.Context, fromAccountID, toAccountID, amount int) (*TransferResult, error) {
-	// First transaction - deduct from source
-	tx1, err := as.mvccService.OpenTx(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("tx1 open failed: %v", err)
-	}
-	defer tx1.Rollback()
-
-	fromAccounts, err := tx1.Where("accounts", "id", fromAccountID)
-	if err != nil || len(fromAccounts) == 0 {
-		return nil, fmt.Errorf("source account not found")
-	}
-
-	fromAcc := Account{
-		ID:      fromAccountID,
-		UserID:  int(fromAccounts[0]["user_id"].(int64)),
-		Balance: int(fromAccounts[0]["balance"].(int64)),
+	if fromAccountID == toAccountID {
+		return nil, fmt.Errorf("cannot transfer to the same account")
 	}
 
-	if fromAcc.Balance < amount {
-		return nil, fmt.Errorf("insufficient balance")
-	}
+	var fromAcc, toAcc Account
+	attempts, err := as.mvccService.RunTx(ctx, func(tx *models.Transaction) error {
+		fromAccounts, err := tx.Where("accounts", "id", fromAccountID)
+		if err != nil {
+			return err
+		}
+		if len(fromAccounts) == 0 {
+			return fmt.Errorf("source account not found")
+		}
 
-	if err = tx1.Update("accounts", fromAccountID,
-		[]string{"balance", "user_id"},
-		fromAcc.Balance-amount, fromAcc.UserID); err != nil {
-		return nil, fmt.Errorf("source update failed: %v", err)
-	}
+		fromAcc = Account{
+			ID:      fromAccountID,
+			UserID:  int(fromAccounts[0]["user_id"].(int64)),
+			Balance: int(fromAccounts[0]["balance"].(int64)),
+		}
 
-	if err = tx1.Commit(); err != nil {
-		return nil, fmt.Errorf("tx1 commit failed: %v", err)
-	}
+		if fromAcc.Balance < amount {
+			return fmt.Errorf("insufficient balance")
+		}
 
-	// Second transaction - add to destination
-	tx2, err := as.mvccService.OpenTx(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("tx2 open failed: %v", err)
-	}
-	defer tx2.Rollback()
+		toAccounts, err := tx.Where("accounts", "id", toAccountID)
+		if err != nil {
+			return err
+		}
+		if len(toAccounts) == 0 {
+			return fmt.Errorf("destination account not found")
+		}
 
-	toAccounts, err := tx2.Where("accounts", "id", toAccountID)
-	if err != nil || len(toAccounts) == 0 {
-		return nil, fmt.Errorf("destination account not found")
-	}
+		toAcc = Account{
+			ID:      toAccountID,
+			UserID:  int(toAccounts[0]["user_id"].(int64)),
+			Balance: int(toAccounts[0]["balance"].(int64)),
+		}
 
-	toAcc := Account{
-		ID:      toAccountID,
-		UserID:  int(toAccounts[0]["user_id"].(int64)),
-		Balance: int(toAccounts[0]["balance"].(int64)),
-	}
+		if err = tx.Update("accounts", fromAccountID,
+			[]string{"balance", "user_id"},
+			fromAcc.Balance-amount, fromAcc.UserID); err != nil {
+			return fmt.Errorf("source update failed: %w", err)
+		}
 
-	if err = tx2.Update("accounts", toAccountID,
-		[]string{"balance", "user_id"},
-		toAcc.Balance+amount, toAcc.UserID); err != nil {
-		return nil, fmt.Errorf("destination update failed: %v", err)
-	}
+		if err = tx.Update("accounts", toAccountID,
+			[]string{"balance", "user_id"},
+			toAcc.Balance+amount, toAcc.UserID); err != nil {
+			return fmt.Errorf("destination update failed: %w", err)
+		}
 
-	if err = tx2.Commit(); err != nil {
-		return nil, fmt.Errorf("tx2 commit failed: %v", err)
-	}
+		if _, err = tx.Insert("audit", []string{"timestamp", "operation", "user_id"},
+			time.Now(), "transfer", fromAcc.UserID); err != nil {
+			return fmt.Errorf("audit creation failed: %w", err)
+		}
 
-	// Third transaction - audit entry
-	tx3, err := as.mvccService.OpenTx(ctx)
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("tx3 open failed: %v", err)
-	}
-	defer tx3.Rollback()
-
-	if _, err = tx3.Insert("audit", []string{"timestamp", "operation", "user_id"},
-		time.Now(), "transfer", fromAcc.UserID); err != nil {
-		return nil, fmt.Errorf("audit creation failed: %v", err)
-	}
-
-	if err = tx3.Commit(); err != nil {
-		return nil, fmt.Errorf("tx3 commit failed: %v", err)
+		return nil, fmt.Errorf("transfer failed after %d attempt(s): %w", attempts, err)
 	}
 
 	fromAcc.Balance -= amount
@@ -218,5 +251,6 @@ func (as *AccountService) Transfer(ctx context.Context, fromAccountID, toAccount
 	return &TransferResult{
 		FromAccount: &fromAcc,
 		ToAccount:   &toAcc,
+		Attempts:    attempts,
 	}, nil
 }
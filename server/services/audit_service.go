@@ -15,16 +15,18 @@ func NewAuditService(mvccService *MVCCService) *AuditService {
 	return &AuditService{mvccService: mvccService}
 }
 
+// GetAudits reads a snapshot in a read-only transaction, audits are read far
+// more often than written
 func (as *AuditService) GetAudits(ctx context.Context, userID int) ([]*models.Audit, error) {
-	tx, err := as.mvccService.OpenTx(ctx)
+	tx, err := as.mvccService.OpenReadOnlyTx(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open transaction: %v", err)
+		return nil, err
 	}
 	defer tx.Rollback()
 
 	results, err := tx.SelectByColumn("audit", "user_id", userID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch audits: %v", err)
+		return nil, fmt.Errorf("failed to fetch audits: %w", err)
 	}
 
 	audits := make([]*models.Audit, 0, len(results))
@@ -46,7 +48,7 @@ func (as *AuditService) GetAudits(ctx context.Context, userID int) ([]*models.Au
 	}
 
 	if err = tx.Commit(); err != nil {
-		return nil, fmt.Errorf("failed to commit: %v", err)
+		return nil, err
 	}
 
 	return audits, nil
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"context"
+	"dt/models"
+	"dt/utils/log"
+	"sync"
+	"time"
+)
+
+// number of vacuum runs kept for the stats endpoint
+const maxVacuumRuns = 100
+
+type VacuumStats struct {
+	Tables []models.TableStats `json:"tables"`
+	Runs   []models.VacuumRun  `json:"runs"`
+}
+
+// vacuumLog keeps the most recent vacuum runs, newest last
+type vacuumLog struct {
+	mu   sync.Mutex
+	runs []models.VacuumRun
+}
+
+func (l *vacuumLog) add(runs ...models.VacuumRun) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.runs = append(l.runs, runs...)
+	if len(l.runs) > maxVacuumRuns {
+		l.runs = l.runs[len(l.runs)-maxVacuumRuns:]
+	}
+}
+
+func (l *vacuumLog) recent() []models.VacuumRun {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]models.VacuumRun{}, l.runs...)
+}
+
+// runAutovacuum periodically vacuums the tables with too many dead versions
+func (mvccs *MVCCService) runAutovacuum(ctx context.Context) {
+	ticker := time.NewTicker(mvccs.config.AutovacuumInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := mvccs.autovacuum(ctx); err != nil {
+				log.Error("Autovacuum failed: %v", err)
+			}
+		}
+	}
+}
+
+func (mvccs *MVCCService) autovacuum(ctx context.Context) error {
+	stats, err := models.VersionStats(ctx)
+	if err != nil {
+		return err
+	}
+
+	var tables []string
+	for _, s := range stats {
+		if s.Dead == 0 {
+			continue
+		}
+		ratio := float64(s.Dead) / float64(s.Versions)
+		if s.Dead >= mvccs.config.AutovacuumThreshold || ratio >= mvccs.config.AutovacuumRatio {
+			tables = append(tables, s.Table)
+		}
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+
+	runs, err := models.VacuumTables(ctx, tables)
+	mvccs.vacuumLog.add(runs...)
+	for _, run := range runs {
+		log.Info("Autovacuum removed %d of %d candidate versions from %s in %v",
+			run.Deleted, run.Scanned, run.Table, run.Duration)
+	}
+	return err
+}
+
+// VacuumStats returns the current version counts of every table and the
+// most recent vacuum runs
+func (mvccs *MVCCService) VacuumStats(ctx context.Context) (*VacuumStats, error) {
+	tables, err := models.VersionStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &VacuumStats{Tables: tables, Runs: mvccs.vacuumLog.recent()}, nil
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"dt/models"
+	"dt/utils"
+	"dt/utils/log"
+	"strconv"
+	"time"
+)
+
+type MVCCConfig struct {
+	Scheduler             models.Scheduler
+	DeadlockPolicy        models.DeadlockPolicy
+	VictimPolicy          models.VictimPolicy
+	DeadlockCheckInterval time.Duration
+	// default lifetime of a transaction, and the age at which an active
+	// transaction row nobody owns is reaped
+	MaxTxDuration  time.Duration
+	ReaperInterval time.Duration
+	// how long vacuum keeps the versions ended by recent transactions
+	HistoryRetention time.Duration
+	// autovacuum checks the tables every interval and vacuums those with at
+	// least threshold dead versions, or a dead fraction of at least ratio
+	AutovacuumInterval  time.Duration
+	AutovacuumThreshold int
+	AutovacuumRatio     float64
+}
+
+func LoadMVCCConfigFromEnv() *MVCCConfig {
+	return &MVCCConfig{
+		Scheduler:             models.Scheduler(utils.GetEnvOrDefault("SCHEDULER", string(models.LockingScheduler))),
+		DeadlockPolicy:        models.DeadlockPolicy(utils.GetEnvOrDefault("DEADLOCK_POLICY", string(models.DeadlockDetection))),
+		VictimPolicy:          models.VictimPolicy(utils.GetEnvOrDefault("DEADLOCK_VICTIM_POLICY", string(models.VictimYoungest))),
+		DeadlockCheckInterval: durationFromEnv("DEADLOCK_CHECK_INTERVAL", time.Second),
+		MaxTxDuration:         durationFromEnv("TX_MAX_DURATION", 30*time.Second),
+		ReaperInterval:        durationFromEnv("TX_REAPER_INTERVAL", 5*time.Second),
+		HistoryRetention:      durationFromEnv("HISTORY_RETENTION", time.Hour),
+		AutovacuumInterval:    durationFromEnv("AUTOVACUUM_INTERVAL", 30*time.Second),
+		AutovacuumThreshold:   intFromEnv("AUTOVACUUM_THRESHOLD", 50),
+		AutovacuumRatio:       floatFromEnv("AUTOVACUUM_RATIO", 0.2),
+	}
+}
+
+func durationFromEnv(key string, defaultValue time.Duration) time.Duration {
+	value := utils.GetEnvOrDefault(key, defaultValue.String())
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Warn("Invalid duration %q for %s, using %v", value, key, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
+func intFromEnv(key string, defaultValue int) int {
+	value := utils.GetEnvOrDefault(key, strconv.Itoa(defaultValue))
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Warn("Invalid integer %q for %s, using %d", value, key, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+func floatFromEnv(key string, defaultValue float64) float64 {
+	value := utils.GetEnvOrDefault(key, strconv.FormatFloat(defaultValue, 'f', -1, 64))
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f <= 0 {
+		log.Warn("Invalid number %q for %s, using %v", value, key, defaultValue)
+		return defaultValue
+	}
+	return f
+}
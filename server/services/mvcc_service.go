@@ -4,44 +4,225 @@ import (
 	"context"
 	"database/sql"
 	"dt/models"
+	"dt/utils/log"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	maxTxAttempts  = 5
+	retryBaseDelay = 50 * time.Millisecond
 )
 
 type MVCCService struct {
 	mvccConn *sql.DB
 	appConn  *sql.DB
 
-	transaction []*models.Transaction
+	config *MVCCConfig
+
+	recovery  *models.RecoveryReport
+	vacuumLog vacuumLog
 }
 
-func NewMVCCService(mvccConn, appConn *sql.DB) *MVCCService {
+func NewMVCCService(mvccConn, appConn *sql.DB, config *MVCCConfig) *MVCCService {
 	models.New(appConn, mvccConn)
+	if err := config.Scheduler.Validate(); err != nil {
+		log.Error("Invalid scheduler, using %s: %v", models.LockingScheduler, err)
+		config.Scheduler = models.LockingScheduler
+	}
+	if err := models.SetDeadlockPolicy(config.DeadlockPolicy); err != nil {
+		log.Error("Invalid deadlock policy, using %s: %v", models.DeadlockDetection, err)
+	}
+	if err := models.SetVictimPolicy(config.VictimPolicy); err != nil {
+		log.Error("Invalid deadlock victim policy, using %s: %v", models.VictimYoungest, err)
+	}
+	if err := models.SetHistoryRetention(config.HistoryRetention); err != nil {
+		log.Error("Invalid history retention, keeping no history: %v", err)
+	}
+
 	return &MVCCService{
 		mvccConn: mvccConn,
 		appConn:  appConn,
+		config:   config,
+	}
+}
+
+// LoadSchema discovers and validates the versioned tables, it must run
+// before recovery and before any transaction is opened
+func (mvccs *MVCCService) LoadSchema(ctx context.Context) error {
+	return models.LoadSchema(ctx)
+}
+
+// Start launches the background tasks of the service, they stop with ctx
+func (mvccs *MVCCService) Start(ctx context.Context) {
+	go mvccs.runDeadlockDetector(ctx)
+	go mvccs.runReaper(ctx)
+	go mvccs.runAutovacuum(ctx)
+}
+
+// runReaper periodically rolls back transactions that outlived their
+// deadline
+func (mvccs *MVCCService) runReaper(ctx context.Context) {
+	ticker := time.NewTicker(mvccs.config.ReaperInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reaped, err := models.ReapExpired(ctx, mvccs.config.MaxTxDuration)
+			if err != nil {
+				log.Error("Transaction reaper failed: %v", err)
+			}
+			if reaped > 0 {
+				log.Warn("Reaped %d expired transactions", reaped)
+			}
+		}
+	}
+}
+
+// runDeadlockDetector periodically scans the wait-for graph for deadlocks
+// among transactions that are all already waiting
+func (mvccs *MVCCService) runDeadlockDetector(ctx context.Context) {
+	ticker := time.NewTicker(mvccs.config.DeadlockCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := models.DetectDeadlocks(ctx); err != nil {
+				log.Error("Deadlock detection failed: %v", err)
+			}
+		}
+	}
+}
+
+func (mvccs *MVCCService) RecentDeadlocks(ctx context.Context, limit int) ([]models.Deadlock, error) {
+	return models.RecentDeadlocks(ctx, limit)
+}
+
+func (mvccs *MVCCService) LockGraph(ctx context.Context) (*models.LockGraph, error) {
+	return models.LoadLockGraph(ctx)
+}
+
+func (mvccs *MVCCService) OCCStats() models.OCCStats {
+	return models.OCCMetrics()
+}
+
+// OpenTx opens a transaction using the configured scheduler and maximum
+// duration, opts may override them
+func (mvccs *MVCCService) OpenTx(ctx context.Context, opts ...models.TxOption) (*models.Transaction, error) {
+	opts = append([]models.TxOption{
+		models.WithScheduler(mvccs.config.Scheduler),
+		models.WithMaxDuration(mvccs.config.MaxTxDuration),
+	}, opts...)
+	return models.OpenTx(ctx, opts...)
+}
+
+// OpenReadOnlyTx opens a read-only transaction, it allocates nothing in the
+// mvcc database and needs no cleanup beyond Commit or Rollback
+func (mvccs *MVCCService) OpenReadOnlyTx(ctx context.Context, opts ...models.TxOption) (*models.Transaction, error) {
+	return models.OpenReadOnlyTx(ctx, opts...)
+}
+
+// RunTx runs fn inside a transaction and commits it. When the scheduler aborts
+// the transaction it is restarted with exponential backoff, up to
+// maxTxAttempts times. Unless the scheduler orders transactions by timestamp,
+// restarts keep the original timestamp so they are not starved by the
+// deadlock prevention policies. The number of attempts made is returned with
+// the error.
+func (mvccs *MVCCService) RunTx(ctx context.Context, fn func(tx *models.Transaction) error, opts ...models.TxOption) (int, error) {
+	var err error
+	var timestamp int64
+	for attempt := 1; attempt <= maxTxAttempts; attempt++ {
+		attemptOpts := opts
+		if timestamp != 0 && !mvccs.config.Scheduler.OrdersTimestamps() {
+			attemptOpts = append([]models.TxOption{models.WithTimestamp(timestamp)}, opts...)
+		}
+
+		timestamp, err = mvccs.runTxOnce(ctx, fn, attemptOpts...)
+		if err == nil || !models.IsRetryable(err) {
+			return attempt, err
+		}
+
+		backoff := retryBaseDelay << (attempt - 1)
+		backoff += rand.N(backoff)
+		log.Warn("Transaction aborted on attempt %d, restarting in %v: %v", attempt, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return attempt, ctx.Err()
+		case <-time.After(backoff):
+		}
 	}
+	return maxTxAttempts, err
 }
 
-func (mvccs *MVCCService) OpenTx(ctx context.Context) (*models.Transaction, error) {
-	tx, err := models.OpenTx(ctx)
+// runTxOnce returns the timestamp of the transaction it opened
+func (mvccs *MVCCService) runTxOnce(ctx context.Context, fn func(tx *models.Transaction) error, opts ...models.TxOption) (int64, error) {
+	tx, err := mvccs.OpenTx(ctx, opts...)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	mvccs.transaction = append(mvccs.transaction, tx)
+	err = fn(tx)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		tx.Rollback()
+		// statements failing because another transaction aborted tx report
+		// the cancellation, surface the abort reason instead
+		if reason := tx.AbortReason(); reason != nil && !models.IsRetryable(err) {
+			err = fmt.Errorf("%w (%v)", reason, err)
+		}
+	}
+	return tx.Timestamp(), err
+}
+
+// Recover cleans up the transactions interrupted by a crash and keeps the
+// report for the admin endpoint
+func (mvccs *MVCCService) Recover(ctx context.Context) (*models.RecoveryReport, error) {
+	report, err := models.Recover(ctx)
+	mvccs.recovery = report
+	return report, err
+}
 
-	return tx, nil
+func (mvccs *MVCCService) RecoveryReport() *models.RecoveryReport {
+	return mvccs.recovery
 }
 
 func (mvccs *MVCCService) Vacuum() (int, error) {
 	ctx, stop := context.WithCancel(context.Background())
 	defer stop()
 
-	return models.Vacuum(ctx)
+	return mvccs.VacuumContext(ctx)
+}
+
+// VacuumContext vacuums every versioned table and returns the number of
+// versions deleted
+func (mvccs *MVCCService) VacuumContext(ctx context.Context) (int, error) {
+	runs, err := models.VacuumTables(ctx, models.VersionedTables())
+	mvccs.vacuumLog.add(runs...)
+
+	deleted := 0
+	for _, run := range runs {
+		deleted += run.Deleted
+	}
+	return deleted, err
+}
+
+func (mvccs *MVCCService) CollectMetadata(ctx context.Context) (*models.MetadataGCReport, error) {
+	return models.CollectMetadata(ctx)
 }
 
 func (mvccs *MVCCService) Cleanup() {
 	// commit all open transactions
-	for _, tx := range mvccs.transaction {
+	for _, tx := range models.LiveTransactions() {
 		tx.Commit()
 	}
 	mvccs.Vacuum()
@@ -16,7 +16,7 @@ func NewUserService(mvccService *MVCCService) *UserService {
 }
 
 func (us *UserService) GetUser(ctx context.Context, userID int) (*models.User, error) {
-	tx, err := us.mvccService.OpenTx(ctx)
+	tx, err := us.mvccService.OpenReadOnlyTx(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -39,38 +39,31 @@ func (us *UserService) GetUser(ctx context.Context, userID int) (*models.User, e
 	return user, nil
 }
 
+// CreateUser creates the user unless the username is taken. Aborted attempts
+// are restarted by RunTx.
 func (us *UserService) CreateUser(ctx context.Context, user *models.User) error {
 	log.Debug("Creating user with data: %v", user)
-	tx, err := us.mvccService.OpenTx(ctx)
+	_, err := us.mvccService.RunTx(ctx, func(tx *models.Transaction) error {
+		// Check if username exists
+		existing, err := tx.Where("users", "username", user.Username)
+		if err != nil {
+			log.Error("Error checking username: %v", err)
+			return err
+		}
+		if len(existing) > 0 {
+			return fmt.Errorf("username already exists")
+		}
+
+		id, err := tx.Insert("users", []string{"username"}, user.Username)
+		if err != nil {
+			log.Error("Error inserting user: %v", err)
+			return err
+		}
+		user.ID = id
+		return nil
+	})
 	if err != nil {
-		log.Error("Error opening transaction: %v", err)
-		tx.Rollback()
-		return err
-	}
-
-	// Check if username exists
-	existing, err := tx.Where("users", "username", user.Username)
-	if err != nil {
-		log.Error("Error checking username: %v", err)
-		tx.Rollback()
-		return err
-	}
-	if len(existing) > 0 {
-		tx.Rollback()
-		return fmt.Errorf("username already exists")
-	}
-
-	id, err := tx.Insert("users", []string{"username"}, user.Username)
-	if err != nil {
-		log.Error("Error inserting user: %v", err)
-		tx.Rollback()
-		return err
-	}
-	user.ID = id
-
-	err = tx.Commit()
-	if err != nil {
-		log.Error("Error committing transaction: %v", err)
+		log.Error("Error creating user: %v", err)
 		return err
 	}
 
@@ -79,7 +72,7 @@ func (us *UserService) CreateUser(ctx context.Context, user *models.User) error
 
 func (us *UserService) GetUserByUsername(ctx context.Context, username string) (*models.User, error) {
 	log.Debug("Service: Getting user by username: %v", username)
-	tx, err := us.mvccService.OpenTx(ctx)
+	tx, err := us.mvccService.OpenReadOnlyTx(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -112,8 +105,10 @@ func (us *UserService) GetUserByUsername(ctx context.Context, username string) (
 	return user, nil
 }
 
+// ListUsers reads a snapshot in a read-only transaction, the scan takes no
+// locks and never aborts
 func (us *UserService) ListUsers(ctx context.Context) ([]models.User, error) {
-	tx, err := us.mvccService.OpenTx(ctx)
+	tx, err := us.mvccService.OpenReadOnlyTx(ctx)
 	if err != nil {
 		return nil, err
 	}